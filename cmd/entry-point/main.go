@@ -1,19 +1,30 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
 	"crypto/x509"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+	"strconv"
 
+	"github.com/samlior/tcp-reverse-proxy/pkg/admin"
 	"github.com/samlior/tcp-reverse-proxy/pkg/common"
+	"github.com/samlior/tcp-reverse-proxy/pkg/constant"
 	entry_point "github.com/samlior/tcp-reverse-proxy/pkg/entry-point"
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+	"github.com/samlior/tcp-reverse-proxy/pkg/metrics"
+	"github.com/samlior/tcp-reverse-proxy/pkg/protocol"
+	"github.com/samlior/tcp-reverse-proxy/pkg/udp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
+	logger = logging.New("main")
+
 	BuildTime string
 	GitCommit string
 
@@ -24,38 +35,144 @@ var (
 		Run: func(cmd *cobra.Command, args []string) {
 			serverCert := viper.GetString("serverCert")
 			authPrivateKey := viper.GetString("authPrivateKey")
-			serverAddress := viper.GetString("serverAddress")
-			groupId := viper.GetUint8("groupId")
+			clientCert := viper.GetString("clientCert")
+			clientKey := viper.GetString("clientKey")
+			serverAddresses := viper.GetStringSlice("serverAddress")
+			group := viper.GetString("group")
+			multiplex := viper.GetInt("multiplex")
+			minPoolSize := viper.GetInt("minPoolSize")
+			maxPoolSize := viper.GetInt("maxPoolSize")
+			dialTimeout := viper.GetDuration("dialTimeout")
+			maxBackoff := viper.GetDuration("maxBackoff")
+			maxQueue := viper.GetInt("maxQueue")
+			maxQueuePerGroup := viper.GetInt("maxQueuePerGroup")
+			maxWait := viper.GetDuration("maxWait")
+			resetOnReject := viper.GetBool("resetOnReject")
+			connUploadLimit := parseLimit("connUploadLimit")
+			connDownloadLimit := parseLimit("connDownloadLimit")
 			_routes := viper.GetStringSlice("routes")
+			allowClients := viper.GetStringSlice("allowClients")
+			denyClients := viper.GetStringSlice("denyClients")
+			proxyProtocol := viper.GetStringSlice("proxyProtocol")
+			trustedProxies := viper.GetStringSlice("trustedProxies")
+			metricsAddress := viper.GetString("metricsAddress")
+			adminAddress := viper.GetString("adminAddress")
+			adminToken := viper.GetString("adminToken")
+
+			if adminAddress != "" && adminToken == "" {
+				logging.Fatal(logger, "admin-token is required by the admin api")
+			}
 
 			if len(_routes) == 0 {
-				log.Fatal("routes is required")
+				logging.Fatal(logger, "routes is required")
 			}
 
-			serverCertBytes, err := os.ReadFile(serverCert)
+			if len(serverAddresses) == 0 {
+				logging.Fatal(logger, "server address is required")
+			}
+
+			if minPoolSize < 1 || maxPoolSize < minPoolSize {
+				logging.Fatal(logger, "invalid pool size, expected 1 <= min-pool-size <= max-pool-size")
+			}
+
+			// the deprecated numeric group id is the same as the group named after it
+			if viper.IsSet("groupId") {
+				group = viper.GetString("groupId")
+			}
+			err := protocol.ValidateGroup(group)
 			if err != nil {
-				log.Fatal("failed to read server certificate:", err)
+				logging.Fatal(logger, "invalid group", logging.Err(err))
 			}
-			authPrivateKeyBytes, err := os.ReadFile(authPrivateKey)
+
+			serverCertBytes, err := os.ReadFile(serverCert)
 			if err != nil {
-				log.Fatal("failed to read auth private key:", err)
+				logging.Fatal(logger, "failed to read server certificate", logging.Err(err))
+			}
+
+			// the auth private key is optional when we are authenticated by a client certificate
+			var authPrivateKeyBytes []byte
+			if clientCert == "" || viper.IsSet("authPrivateKey") {
+				authPrivateKeyBytes, err = os.ReadFile(authPrivateKey)
+				if err != nil {
+					logging.Fatal(logger, "failed to read auth private key", logging.Err(err))
+				}
+				if len(authPrivateKeyBytes) != ed25519.PrivateKeySize {
+					logging.Fatal(logger, "invalid auth private key size", slog.Int("size", len(authPrivateKeyBytes)))
+				}
 			}
 
 			certPool := x509.NewCertPool()
 			ok := certPool.AppendCertsFromPEM(serverCertBytes)
 			if !ok {
-				log.Fatal("failed to append the server certificate")
+				logging.Fatal(logger, "failed to append the server certificate")
+			}
+
+			tlsConfig := &tls.Config{
+				RootCAs: certPool,
+			}
+			if clientCert != "" {
+				cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+				if err != nil {
+					logging.Fatal(logger, "failed to load client certificate", logging.Err(err))
+				}
+				tlsConfig.Certificates = []tls.Certificate{cert}
 			}
 
 			routes, err := entry_point.ParseRoutes(_routes)
 			if err != nil {
-				log.Fatal("failed to parse routes:", err)
+				logging.Fatal(logger, "failed to parse routes", logging.Err(err))
+			}
+
+			err = entry_point.ApplyClientRules(routes, allowClients, denyClients)
+			if err != nil {
+				logging.Fatal(logger, "failed to parse client rules", logging.Err(err))
 			}
 
-			entryPointServer := entry_point.NewEntryPointServer(groupId, serverAddress, authPrivateKeyBytes, certPool, routes)
+			// a client could forge its own address if any source were trusted
+			if len(proxyProtocol) > 0 && len(trustedProxies) == 0 {
+				logging.Fatal(logger, "trusted-proxies is required by proxy-protocol")
+			}
+
+			err = entry_point.ApplyProxyProtocol(routes, proxyProtocol)
+			if err != nil {
+				logging.Fatal(logger, "failed to parse proxy protocol routes", logging.Err(err))
+			}
+
+			trustedProxyPrefixes, err := entry_point.ParseTrustedProxies(trustedProxies)
+			if err != nil {
+				logging.Fatal(logger, "failed to parse trusted proxies", logging.Err(err))
+			}
+
+			entryPointServer := entry_point.NewEntryPointServer(group, serverAddresses, authPrivateKeyBytes, tlsConfig, multiplex, minPoolSize, maxPoolSize, routes)
+
+			entryPointServer.DialTimeout = dialTimeout
+			entryPointServer.MaxBackoff = maxBackoff
+			entryPointServer.MaxQueue = maxQueue
+			entryPointServer.MaxQueuePerGroup = maxQueuePerGroup
+			entryPointServer.MaxWait = maxWait
+			entryPointServer.ResetOnReject = resetOnReject
+			entryPointServer.ConnUploadLimit = connUploadLimit
+			entryPointServer.ConnDownloadLimit = connDownloadLimit
+			entryPointServer.TrustedProxies = trustedProxyPrefixes
 
 			go common.HandleSignal(entryPointServer)
 
+			if metricsAddress != "" {
+				logger.Info("serving metrics", slog.String("address", metricsAddress))
+				go func() {
+					logging.Fatal(logger, "failed to serve metrics", logging.Err(metrics.Serve(metricsAddress, entryPointServer.Collector())))
+				}()
+			}
+
+			if adminAddress != "" {
+				logger.Info("serving the admin api", slog.String("address", adminAddress))
+				go func() {
+					logging.Fatal(logger, "failed to serve the admin api", logging.Err(admin.Serve(adminAddress, entryPointServer.CommonServer, adminToken)))
+				}()
+			}
+
+			go entryPointServer.LogBandwidth(constant.BandwidthLogInterval)
+
 			go entryPointServer.KeepDialing()
 
 			for _, route := range routes {
@@ -64,22 +181,42 @@ var (
 					srcHost = "0.0.0.0"
 				}
 
-				listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", srcHost, route.SrcPort))
+				address := net.JoinHostPort(srcHost, strconv.Itoa(int(route.SrcPort)))
+
+				if route.Network == "udp" {
+					packetConn, err := net.ListenPacket("udp", address)
+					if err != nil {
+						logging.Fatal(logger, "failed to listen", logging.Err(err))
+					}
+
+					logger.Info("listening", slog.String("network", "udp"), slog.String("address", address))
+
+					go udp.NewListener(packetConn, constant.UDPIdleTimeout, entryPointServer.HandleConnection).Serve()
+
+					continue
+				}
+
+				listener, err := net.Listen("tcp", address)
 				if err != nil {
-					log.Fatal("failed to listen:", err)
+					logging.Fatal(logger, "failed to listen", logging.Err(err))
 				}
 
-				log.Printf("listening on %s:%d...", srcHost, route.SrcPort)
+				logger.Info("listening", slog.String("network", "tcp"), slog.String("address", address))
+
+				handleConnection := entryPointServer.HandleConnection
+				if route.ProxyProtocol {
+					handleConnection = entryPointServer.HandleProxiedConnection
+				}
 
 				go func() {
 					for {
 						conn, err := listener.Accept()
 						if err != nil {
-							log.Println("failed to accept connection:", err)
+							logger.Error("failed to accept connection", logging.Err(err))
 							continue
 						}
 
-						go entryPointServer.HandleConnection(conn)
+						go handleConnection(conn)
 					}
 				}()
 			}
@@ -92,7 +229,7 @@ var (
 		Use:   "version",
 		Short: "Show version",
 		Run: func(cmd *cobra.Command, args []string) {
-			log.Printf("tcp-reverse-proxy/entry-point\n  build time: %s +0\n  git commit: %s\n", BuildTime, GitCommit)
+			fmt.Printf("tcp-reverse-proxy/entry-point\n  build time: %s +0\n  git commit: %s\n", BuildTime, GitCommit)
 		},
 	}
 )
@@ -102,37 +239,104 @@ func init() {
 
 	rootCmd.Flags().StringP("server-cert", "c", "cert/server.crt", "server certificate path")
 	rootCmd.Flags().StringP("auth-private-key", "a", "cert/auth", "auth private key path")
-	rootCmd.Flags().StringP("server-address", "s", "localhost:4433", "server address")
-	rootCmd.Flags().StringSliceP("routes", "r", []string{}, "route addresses, separated by commas")
-	rootCmd.Flags().Uint8P("group-id", "g", 0, "group id")
+	rootCmd.Flags().String("client-cert", "", "client certificate path (optional, authenticates with mutual tls)")
+	rootCmd.Flags().String("client-key", "cert/client.key", "client certificate key path")
+	rootCmd.Flags().StringSliceP("server-address", "s", []string{"localhost:4433"}, "relay server addresses in order of preference, separated by commas")
+	rootCmd.Flags().StringSliceP("routes", "r", []string{}, "route addresses, separated by commas, optionally followed by @UPLOAD/DOWNLOAD bandwidth limits")
+	rootCmd.Flags().StringSlice("allow-clients", []string{}, "client cidrs allowed to use the routes, separated by commas, each optionally prefixed by a listening address like 5001= to apply to its route only")
+	rootCmd.Flags().StringSlice("deny-clients", []string{}, "client cidrs rejected by the routes, separated by commas, each optionally prefixed by a listening address like 5001= to apply to its route only")
+	rootCmd.Flags().StringSlice("proxy-protocol", []string{}, "listening addresses of the tcp routes behind a proxy which sends a PROXY protocol header, like 5001, separated by commas")
+	rootCmd.Flags().StringSlice("trusted-proxies", []string{}, "proxy cidrs allowed to send a PROXY protocol header, separated by commas, required by proxy-protocol")
+	rootCmd.Flags().StringP("group", "g", "0", "group name, only the entry-point and reverse-proxy of the same group are connected")
+	rootCmd.Flags().Uint8("group-id", 0, "group id")
+	rootCmd.Flags().MarkDeprecated("group-id", "use --group instead")
+	rootCmd.Flags().IntP("multiplex", "m", 0, "number of multiplexed sessions to the relay server (0 disables multiplexing)")
+	rootCmd.Flags().Int("min-pool-size", constant.DefaultMinPoolSize, "minimum number of idle connections to the relay server")
+	rootCmd.Flags().Int("max-pool-size", constant.DefaultMaxPoolSize, "maximum number of idle connections to the relay server, the pool grows when connections are consumed quickly")
+	rootCmd.Flags().Duration("dial-timeout", constant.DialTimeout, "maximum time allowed to connect to a relay server")
+	rootCmd.Flags().Duration("max-backoff", constant.RelayBackoffMax, "maximum time to wait before dialing a relay server again after it failed")
+	rootCmd.Flags().Int("max-queue", 0, "maximum number of connections waiting for a partner (0 means unlimited)")
+	rootCmd.Flags().Int("max-queue-per-group", 0, "maximum number of connections of a group waiting for a partner (0 means unlimited)")
+	rootCmd.Flags().Duration("max-wait", constant.MaxWait, "maximum time a connection waits for a partner (0 means forever)")
+	rootCmd.Flags().Bool("reset-on-reject", false, "reset rejected and timed out connections instead of closing them gracefully")
+	rootCmd.Flags().String("conn-upload-limit", "0", "upload bandwidth of every session in bytes per second, with an optional K, M or G suffix (0 means unlimited)")
+	rootCmd.Flags().String("conn-download-limit", "0", "download bandwidth of every session in bytes per second, with an optional K, M or G suffix (0 means unlimited)")
+
+	rootCmd.Flags().String("metrics-address", "", "address to serve prometheus metrics on at /metrics, like 127.0.0.1:9100 (disabled if empty)")
+	rootCmd.Flags().String("admin-address", "", "address to serve the admin api on, a loopback address like 127.0.0.1:9200 or a unix socket like unix:/run/admin.sock (disabled if empty)")
+	rootCmd.Flags().String("admin-token", "", "bearer token required by the admin api")
+	rootCmd.Flags().String("log-level", "info", "log level: debug, info, warn or error")
+	rootCmd.Flags().String("log-format", logging.FormatText, "log format: text or json")
 
 	rootCmd.AddCommand(versionCmd)
 
 	viper.BindPFlag("serverCert", rootCmd.Flags().Lookup("server-cert"))
 	viper.BindPFlag("authPrivateKey", rootCmd.Flags().Lookup("auth-private-key"))
+	viper.BindPFlag("clientCert", rootCmd.Flags().Lookup("client-cert"))
+	viper.BindPFlag("clientKey", rootCmd.Flags().Lookup("client-key"))
 	viper.BindPFlag("serverAddress", rootCmd.Flags().Lookup("server-address"))
 	viper.BindPFlag("routes", rootCmd.Flags().Lookup("routes"))
+	viper.BindPFlag("allowClients", rootCmd.Flags().Lookup("allow-clients"))
+	viper.BindPFlag("denyClients", rootCmd.Flags().Lookup("deny-clients"))
+	viper.BindPFlag("proxyProtocol", rootCmd.Flags().Lookup("proxy-protocol"))
+	viper.BindPFlag("trustedProxies", rootCmd.Flags().Lookup("trusted-proxies"))
+	viper.BindPFlag("group", rootCmd.Flags().Lookup("group"))
 	viper.BindPFlag("groupId", rootCmd.Flags().Lookup("group-id"))
+	viper.BindPFlag("multiplex", rootCmd.Flags().Lookup("multiplex"))
+	viper.BindPFlag("minPoolSize", rootCmd.Flags().Lookup("min-pool-size"))
+	viper.BindPFlag("maxPoolSize", rootCmd.Flags().Lookup("max-pool-size"))
+	viper.BindPFlag("dialTimeout", rootCmd.Flags().Lookup("dial-timeout"))
+	viper.BindPFlag("maxBackoff", rootCmd.Flags().Lookup("max-backoff"))
+	viper.BindPFlag("maxQueue", rootCmd.Flags().Lookup("max-queue"))
+	viper.BindPFlag("maxQueuePerGroup", rootCmd.Flags().Lookup("max-queue-per-group"))
+	viper.BindPFlag("maxWait", rootCmd.Flags().Lookup("max-wait"))
+	viper.BindPFlag("resetOnReject", rootCmd.Flags().Lookup("reset-on-reject"))
+	viper.BindPFlag("connUploadLimit", rootCmd.Flags().Lookup("conn-upload-limit"))
+	viper.BindPFlag("connDownloadLimit", rootCmd.Flags().Lookup("conn-download-limit"))
+
+	viper.BindPFlag("metricsAddress", rootCmd.Flags().Lookup("metrics-address"))
+	viper.BindPFlag("adminAddress", rootCmd.Flags().Lookup("admin-address"))
+	viper.BindPFlag("adminToken", rootCmd.Flags().Lookup("admin-token"))
+	viper.BindPFlag("logLevel", rootCmd.Flags().Lookup("log-level"))
+	viper.BindPFlag("logFormat", rootCmd.Flags().Lookup("log-format"))
 
 	viper.AutomaticEnv()
 
 	cobra.OnInitialize(initConfig)
 }
 
+// parseLimit parses the bandwidth limit of the option
+func parseLimit(key string) int {
+	limit, err := common.ParseBandwidth(viper.GetString(key))
+	if err != nil {
+		logging.Fatal(logger, "invalid bandwidth limit", logging.Err(err))
+	}
+	return limit
+}
+
 func initConfig() {
 	cfgFile, _ := rootCmd.Flags().GetString("config")
 	if cfgFile != "" {
 		viper.SetConfigFile(cfgFile)
 		err := viper.ReadInConfig()
 		if err != nil {
-			log.Fatal("failed to read config file:", err)
+			logging.Fatal(logger, "failed to read config file", logging.Err(err))
 		}
-		log.Println("loaded config file:", viper.ConfigFileUsed())
+	}
+
+	// the logs are set up once the config file has been read
+	err := logging.Setup(viper.GetString("logLevel"), viper.GetString("logFormat"))
+	if err != nil {
+		logging.Fatal(logger, "failed to set up logging", logging.Err(err))
+	}
+
+	if cfgFile != "" {
+		logger.Info("loaded config file", slog.String("path", viper.ConfigFileUsed()))
 	}
 }
 
 func main() {
 	if err := rootCmd.Execute(); err != nil {
-		log.Fatal("failed to execute root command:", err)
+		logging.Fatal(logger, "failed to execute root command", logging.Err(err))
 	}
 }
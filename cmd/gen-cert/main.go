@@ -4,15 +4,19 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"log"
 	"math/big"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -99,6 +103,7 @@ var (
 		Long:  "Generate a ed25519 key pair",
 		Run: func(cmd *cobra.Command, args []string) {
 			output, _ := cmd.Flags().GetString("output")
+			name, _ := cmd.Flags().GetString("name")
 
 			// 1. Create output directory if it doesn't exist
 			createOutputDirIfNotExists(output)
@@ -130,10 +135,135 @@ var (
 			}
 			publicKeyFile.Close()
 			fmt.Println("public key saved to", filepath.Join(output, "auth.pub"))
+
+			// 5. Print the line for the authorized keys file of the relay server
+			fmt.Println("authorized keys entry:", name, base64.StdEncoding.EncodeToString(publicKey))
+		},
+	}
+
+	clientCACmd = &cobra.Command{
+		Use:   "client-ca",
+		Short: "Generate a ca for client certificates",
+		Long:  "Generate a ca for client certificates",
+		Run: func(cmd *cobra.Command, args []string) {
+			output, _ := cmd.Flags().GetString("output")
+			name, _ := cmd.Flags().GetString("name")
+
+			// 1. Create output directory if it doesn't exist
+			createOutputDirIfNotExists(output)
+
+			// 2. Generate RSA private key
+			privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				log.Fatalf("failed to generate private key: %v", err)
+			}
+
+			// 3. Create certificate template
+			serialNumber, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+			template := x509.Certificate{
+				SerialNumber:          serialNumber,
+				Subject:               pkix.Name{CommonName: name},
+				NotBefore:             time.Now(),
+				NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour), // valid for 10 years
+				KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+				BasicConstraintsValid: true,
+				IsCA:                  true,
+			}
+
+			// 4. Create self-signed certificate
+			derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+			if err != nil {
+				log.Fatalf("failed to create certificate: %v", err)
+			}
+
+			// 5. Save certificate and private key
+			writePEM(filepath.Join(output, "client-ca.crt"), "CERTIFICATE", derBytes)
+			writePEM(filepath.Join(output, "client-ca.key"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(privateKey))
+		},
+	}
+
+	clientCmd = &cobra.Command{
+		Use:   "client",
+		Short: "Generate a client certificate signed by the client ca",
+		Long:  "Generate a client certificate signed by the client ca",
+		Run: func(cmd *cobra.Command, args []string) {
+			output, _ := cmd.Flags().GetString("output")
+			name, _ := cmd.Flags().GetString("name")
+			roles, _ := cmd.Flags().GetStringSlice("role")
+			groups, _ := cmd.Flags().GetStringSlice("group")
+			caCert, _ := cmd.Flags().GetString("ca-cert")
+			caKey, _ := cmd.Flags().GetString("ca-key")
+
+			if len(roles) == 0 || len(groups) == 0 {
+				log.Fatal("at least one role and one group are required")
+			}
+
+			// 1. Load the client ca
+			ca, err := tls.LoadX509KeyPair(caCert, caKey)
+			if err != nil {
+				log.Fatalf("failed to load client ca: %v", err)
+			}
+			caCertificate, err := x509.ParseCertificate(ca.Certificate[0])
+			if err != nil {
+				log.Fatalf("failed to parse client ca: %v", err)
+			}
+
+			// 2. Create output directory if it doesn't exist
+			createOutputDirIfNotExists(output)
+
+			// 3. Generate RSA private key
+			privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				log.Fatalf("failed to generate private key: %v", err)
+			}
+
+			// 4. Create certificate template,
+			// the claims are carried by SAN URIs
+			var uris []*url.URL
+			for _, role := range roles {
+				if role != "entry-point" && role != "reverse-proxy" {
+					log.Fatalf("invalid role: %s", role)
+				}
+				uris = append(uris, &url.URL{Scheme: "trp", Opaque: "role:" + role})
+			}
+			for _, group := range groups {
+				uris = append(uris, &url.URL{Scheme: "trp", Opaque: "group:" + url.PathEscape(group)})
+			}
+
+			serialNumber, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+			template := x509.Certificate{
+				SerialNumber: serialNumber,
+				Subject:      pkix.Name{CommonName: name},
+				NotBefore:    time.Now(),
+				NotAfter:     time.Now().Add(365 * 24 * time.Hour), // valid for 1 year
+				KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+				URIs:         uris,
+			}
+
+			// 5. Create certificate signed by the client ca
+			derBytes, err := x509.CreateCertificate(rand.Reader, &template, caCertificate, &privateKey.PublicKey, ca.PrivateKey)
+			if err != nil {
+				log.Fatalf("failed to create certificate: %v", err)
+			}
+
+			// 6. Save certificate and private key
+			writePEM(filepath.Join(output, "client.crt"), "CERTIFICATE", derBytes)
+			writePEM(filepath.Join(output, "client.key"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(privateKey))
 		},
 	}
 )
 
+func writePEM(path string, blockType string, bytes []byte) {
+	out, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("failed to create %s: %v", path, err)
+	}
+	pem.Encode(out, &pem.Block{Type: blockType, Bytes: bytes})
+	out.Close()
+	fmt.Println(strings.ToLower(blockType), "saved to", path)
+}
+
 func createOutputDirIfNotExists(output string) {
 	stat, err := os.Stat(output)
 	if os.IsNotExist(err) {
@@ -154,8 +284,20 @@ func init() {
 	x509Cmd.Flags().StringSliceP("dns", "d", []string{}, "DNS name separated by commas")
 	x509Cmd.Flags().StringSliceP("ip", "i", []string{}, "IP address separated by commas")
 
+	ed25519Cmd.Flags().StringP("name", "n", "default", "key name used in the authorized keys entry")
+
+	clientCACmd.Flags().StringP("name", "n", "tcp-reverse-proxy client ca", "common name of the ca")
+
+	clientCmd.Flags().StringP("name", "n", "default", "common name of the client, used as its identity by the relay server")
+	clientCmd.Flags().StringSliceP("role", "r", []string{}, "roles the client may claim (entry-point, reverse-proxy), separated by commas")
+	clientCmd.Flags().StringSliceP("group", "g", []string{}, "groups the client may claim (* for any), separated by commas")
+	clientCmd.Flags().String("ca-cert", "cert/client-ca.crt", "client ca certificate path")
+	clientCmd.Flags().String("ca-key", "cert/client-ca.key", "client ca key path")
+
 	rootCmd.AddCommand(x509Cmd)
 	rootCmd.AddCommand(ed25519Cmd)
+	rootCmd.AddCommand(clientCACmd)
+	rootCmd.AddCommand(clientCmd)
 }
 
 func main() {
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"time"
 
+	"github.com/samlior/tcp-reverse-proxy/pkg/admin"
 	"github.com/samlior/tcp-reverse-proxy/pkg/common"
+	"github.com/samlior/tcp-reverse-proxy/pkg/constant"
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+	"github.com/samlior/tcp-reverse-proxy/pkg/metrics"
 	relay_server "github.com/samlior/tcp-reverse-proxy/pkg/relay-server"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
+	logger = logging.New("main")
+
 	BuildTime string
 	GitCommit string
 
@@ -24,46 +33,162 @@ var (
 			serverCert := viper.GetString("serverCert")
 			serverKey := viper.GetString("serverKey")
 			authPublicKey := viper.GetString("authPublicKey")
+			authorizedKeys := viper.GetString("authorizedKeys")
+			rotationWindow := viper.GetDuration("rotationWindow")
+			terminateRevoked := viper.GetBool("terminateRevoked")
+			authMode := viper.GetString("authMode")
+			balancerName := viper.GetString("balancer")
+			maxQueue := viper.GetInt("maxQueue")
+			maxQueuePerGroup := viper.GetInt("maxQueuePerGroup")
+			maxWait := viper.GetDuration("maxWait")
+			resetOnReject := viper.GetBool("resetOnReject")
+			groupUploadLimit := parseLimit("groupUploadLimit")
+			groupDownloadLimit := parseLimit("groupDownloadLimit")
+			connUploadLimit := parseLimit("connUploadLimit")
+			connDownloadLimit := parseLimit("connDownloadLimit")
+			clientCA := viper.GetString("clientCA")
 			host := viper.GetString("host")
 			port := viper.GetInt("port")
+			metricsAddress := viper.GetString("metricsAddress")
+			adminAddress := viper.GetString("adminAddress")
+			adminToken := viper.GetString("adminToken")
+
+			if adminAddress != "" && adminToken == "" {
+				logging.Fatal(logger, "admin-token is required by the admin api")
+			}
+
+			if authMode != relay_server.AuthModeEd25519 && authMode != relay_server.AuthModeMTLS && authMode != relay_server.AuthModeAny {
+				logging.Fatal(logger, "invalid auth mode", slog.String("auth_mode", authMode))
+			}
+			if authMode != relay_server.AuthModeEd25519 && clientCA == "" {
+				logging.Fatal(logger, "client-ca is required by the auth mode", slog.String("auth_mode", authMode))
+			}
+
+			balancer, err := common.NewBalancer(balancerName)
+			if err != nil {
+				logging.Fatal(logger, "invalid balancer", logging.Err(err))
+			}
 
 			serverCertBytes, err := os.ReadFile(serverCert)
 			if err != nil {
-				log.Fatal("failed to read server certificate:", err)
+				logging.Fatal(logger, "failed to read server certificate", logging.Err(err))
 			}
 			serverKeyBytes, err := os.ReadFile(serverKey)
 			if err != nil {
-				log.Fatal("failed to read server key:", err)
+				logging.Fatal(logger, "failed to read server key", logging.Err(err))
 			}
-			authPublicKeyBytes, err := os.ReadFile(authPublicKey)
+
+			keysPath := authPublicKey
+			loadKeys := func() ([]*relay_server.AuthorizedKey, error) {
+				authPublicKeyBytes, err := os.ReadFile(authPublicKey)
+				if err != nil {
+					return nil, err
+				}
+				if len(authPublicKeyBytes) != ed25519.PublicKeySize {
+					return nil, fmt.Errorf("invalid auth public key size: %d", len(authPublicKeyBytes))
+				}
+
+				// a single key may claim every role and group
+				return []*relay_server.AuthorizedKey{{
+					Name:      "default",
+					PublicKey: authPublicKeyBytes,
+				}}, nil
+			}
+			if authorizedKeys != "" {
+				keysPath = authorizedKeys
+				loadKeys = func() ([]*relay_server.AuthorizedKey, error) {
+					return relay_server.LoadAuthorizedKeys(authorizedKeys)
+				}
+			}
+
+			// no key is needed when only client certificates are accepted
+			var keys []*relay_server.AuthorizedKey
+			if authMode != relay_server.AuthModeMTLS {
+				keys, err = loadKeys()
+				if err != nil {
+					logging.Fatal(logger, "failed to read authorized keys", logging.Err(err))
+				}
+			}
+
+			keyring, err := relay_server.NewKeyring(keys)
 			if err != nil {
-				log.Fatal("failed to read auth public key:", err)
+				logging.Fatal(logger, "failed to load authorized keys", logging.Err(err))
 			}
 
+			logger.Info("loaded authorized keys", slog.Int("keys", len(keys)))
+
 			cert, err := tls.X509KeyPair(serverCertBytes, serverKeyBytes)
 			if err != nil {
-				log.Fatal("failed to create x509 key pair:", err)
+				logging.Fatal(logger, "failed to create x509 key pair", logging.Err(err))
 			}
 
-			listener, err := tls.Listen("tcp", fmt.Sprintf("%s:%d", host, port), &tls.Config{
+			tlsConfig := &tls.Config{
 				Certificates: []tls.Certificate{cert},
-			})
+			}
+			if clientCA != "" {
+				clientCABytes, err := os.ReadFile(clientCA)
+				if err != nil {
+					logging.Fatal(logger, "failed to read client ca", logging.Err(err))
+				}
+
+				clientCAs := x509.NewCertPool()
+				if !clientCAs.AppendCertsFromPEM(clientCABytes) {
+					logging.Fatal(logger, "failed to append client ca to cert pool")
+				}
+
+				tlsConfig.ClientCAs = clientCAs
+				if authMode == relay_server.AuthModeMTLS {
+					tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+				} else {
+					tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+				}
+			}
+
+			listener, err := tls.Listen("tcp", fmt.Sprintf("%s:%d", host, port), tlsConfig)
 			if err != nil {
-				log.Fatal("failed to listen:", err)
+				logging.Fatal(logger, "failed to listen", logging.Err(err))
 			}
 
 			defer listener.Close()
 
-			log.Printf("listening on %s:%d...", host, port)
+			logger.Info("listening", slog.String("address", fmt.Sprintf("%s:%d", host, port)))
 
-			relayServer := relay_server.NewRelayServer(authPublicKeyBytes)
+			relayServer := relay_server.NewRelayServer(keyring, authMode, balancer)
+			relayServer.MaxQueue = maxQueue
+			relayServer.MaxQueuePerGroup = maxQueuePerGroup
+			relayServer.MaxWait = maxWait
+			relayServer.ResetOnReject = resetOnReject
+			relayServer.GroupUploadLimit = groupUploadLimit
+			relayServer.GroupDownloadLimit = groupDownloadLimit
+			relayServer.ConnUploadLimit = connUploadLimit
+			relayServer.ConnDownloadLimit = connDownloadLimit
 
 			go common.HandleSignal(relayServer)
 
+			if metricsAddress != "" {
+				logger.Info("serving metrics", slog.String("address", metricsAddress))
+				go func() {
+					logging.Fatal(logger, "failed to serve metrics", logging.Err(metrics.Serve(metricsAddress, relayServer.Collector())))
+				}()
+			}
+
+			if adminAddress != "" {
+				logger.Info("serving the admin api", slog.String("address", adminAddress))
+				go func() {
+					logging.Fatal(logger, "failed to serve the admin api", logging.Err(admin.Serve(adminAddress, relayServer.CommonServer, adminToken)))
+				}()
+			}
+
+			go relayServer.LogBandwidth(constant.BandwidthLogInterval)
+
+			if authMode != relay_server.AuthModeMTLS {
+				go relayServer.WatchKeys(keysPath, loadKeys, rotationWindow, terminateRevoked)
+			}
+
 			for {
 				conn, err := listener.Accept()
 				if err != nil {
-					log.Println("failed to accept connection:", err)
+					logger.Error("failed to accept connection", logging.Err(err))
 					continue
 				}
 
@@ -76,7 +201,7 @@ var (
 		Use:   "version",
 		Short: "Show version",
 		Run: func(cmd *cobra.Command, args []string) {
-			log.Printf("tcp-reverse-proxy/relay-server\n  build time: %s +0\n  git commit: %s\n", BuildTime, GitCommit)
+			fmt.Printf("tcp-reverse-proxy/relay-server\n  build time: %s +0\n  git commit: %s\n", BuildTime, GitCommit)
 		},
 	}
 )
@@ -87,37 +212,94 @@ func init() {
 	rootCmd.Flags().StringP("server-cert", "c", "cert/server.crt", "server certificate path")
 	rootCmd.Flags().StringP("server-key", "k", "cert/server.key", "server key path")
 	rootCmd.Flags().StringP("auth-public-key", "a", "cert/auth.pub", "auth public key path")
+	rootCmd.Flags().String("authorized-keys", "", "authorized keys file path (optional, takes precedence over auth-public-key)")
+	rootCmd.Flags().Duration("rotation-window", time.Minute*10, "how long removed keys are still accepted after a reload")
+	rootCmd.Flags().Bool("terminate-revoked", false, "terminate live connections authenticated by revoked keys")
+	rootCmd.Flags().String("auth-mode", relay_server.AuthModeEd25519, "client authentication mode: ed25519, mtls or any")
+	rootCmd.Flags().String("client-ca", "", "client ca certificate path, required by the mtls and any auth modes")
+	rootCmd.Flags().String("balancer", common.BalancerFirst, "how to choose among the clients of a group: first, round-robin, least-active, weighted or affinity")
+	rootCmd.Flags().Int("max-queue", 0, "maximum number of connections waiting for a partner (0 means unlimited)")
+	rootCmd.Flags().Int("max-queue-per-group", 0, "maximum number of connections of a group waiting for a partner (0 means unlimited)")
+	rootCmd.Flags().Duration("max-wait", constant.MaxWait, "maximum time a connection waits for a partner (0 means forever)")
+	rootCmd.Flags().Bool("reset-on-reject", false, "reset rejected and timed out connections instead of closing them gracefully")
+	rootCmd.Flags().String("group-upload-limit", "0", "upload bandwidth shared by the sessions of every group in bytes per second, with an optional K, M or G suffix (0 means unlimited)")
+	rootCmd.Flags().String("group-download-limit", "0", "download bandwidth shared by the sessions of every group in bytes per second, with an optional K, M or G suffix (0 means unlimited)")
+	rootCmd.Flags().String("conn-upload-limit", "0", "upload bandwidth of every session in bytes per second, with an optional K, M or G suffix (0 means unlimited)")
+	rootCmd.Flags().String("conn-download-limit", "0", "download bandwidth of every session in bytes per second, with an optional K, M or G suffix (0 means unlimited)")
 	rootCmd.Flags().String("host", "0.0.0.0", "host")
 	rootCmd.Flags().IntP("port", "p", 4433, "port")
 
+	rootCmd.Flags().String("metrics-address", "", "address to serve prometheus metrics on at /metrics, like 127.0.0.1:9100 (disabled if empty)")
+	rootCmd.Flags().String("admin-address", "", "address to serve the admin api on, a loopback address like 127.0.0.1:9200 or a unix socket like unix:/run/admin.sock (disabled if empty)")
+	rootCmd.Flags().String("admin-token", "", "bearer token required by the admin api")
+	rootCmd.Flags().String("log-level", "info", "log level: debug, info, warn or error")
+	rootCmd.Flags().String("log-format", logging.FormatText, "log format: text or json")
+
 	rootCmd.AddCommand(versionCmd)
 
 	viper.BindPFlag("serverCert", rootCmd.Flags().Lookup("server-cert"))
 	viper.BindPFlag("serverKey", rootCmd.Flags().Lookup("server-key"))
 	viper.BindPFlag("authPublicKey", rootCmd.Flags().Lookup("auth-public-key"))
+	viper.BindPFlag("authorizedKeys", rootCmd.Flags().Lookup("authorized-keys"))
+	viper.BindPFlag("rotationWindow", rootCmd.Flags().Lookup("rotation-window"))
+	viper.BindPFlag("terminateRevoked", rootCmd.Flags().Lookup("terminate-revoked"))
+	viper.BindPFlag("authMode", rootCmd.Flags().Lookup("auth-mode"))
+	viper.BindPFlag("clientCA", rootCmd.Flags().Lookup("client-ca"))
+	viper.BindPFlag("balancer", rootCmd.Flags().Lookup("balancer"))
+	viper.BindPFlag("maxQueue", rootCmd.Flags().Lookup("max-queue"))
+	viper.BindPFlag("maxQueuePerGroup", rootCmd.Flags().Lookup("max-queue-per-group"))
+	viper.BindPFlag("maxWait", rootCmd.Flags().Lookup("max-wait"))
+	viper.BindPFlag("resetOnReject", rootCmd.Flags().Lookup("reset-on-reject"))
+	viper.BindPFlag("groupUploadLimit", rootCmd.Flags().Lookup("group-upload-limit"))
+	viper.BindPFlag("groupDownloadLimit", rootCmd.Flags().Lookup("group-download-limit"))
+	viper.BindPFlag("connUploadLimit", rootCmd.Flags().Lookup("conn-upload-limit"))
+	viper.BindPFlag("connDownloadLimit", rootCmd.Flags().Lookup("conn-download-limit"))
 	viper.BindPFlag("host", rootCmd.Flags().Lookup("host"))
 	viper.BindPFlag("port", rootCmd.Flags().Lookup("port"))
 
+	viper.BindPFlag("metricsAddress", rootCmd.Flags().Lookup("metrics-address"))
+	viper.BindPFlag("adminAddress", rootCmd.Flags().Lookup("admin-address"))
+	viper.BindPFlag("adminToken", rootCmd.Flags().Lookup("admin-token"))
+	viper.BindPFlag("logLevel", rootCmd.Flags().Lookup("log-level"))
+	viper.BindPFlag("logFormat", rootCmd.Flags().Lookup("log-format"))
+
 	viper.AutomaticEnv()
 
 	cobra.OnInitialize(initConfig)
 }
 
+// parseLimit parses the bandwidth limit of the option
+func parseLimit(key string) int {
+	limit, err := common.ParseBandwidth(viper.GetString(key))
+	if err != nil {
+		logging.Fatal(logger, "invalid bandwidth limit", logging.Err(err))
+	}
+	return limit
+}
+
 func initConfig() {
 	cfgFile, _ := rootCmd.Flags().GetString("config")
 	if cfgFile != "" {
 		viper.SetConfigFile(cfgFile)
 		err := viper.ReadInConfig()
 		if err != nil {
-			log.Fatal("failed to read config file:", err)
-			os.Exit(1)
+			logging.Fatal(logger, "failed to read config file", logging.Err(err))
 		}
-		log.Println("loaded config file:", viper.ConfigFileUsed())
+	}
+
+	// the logs are set up once the config file has been read
+	err := logging.Setup(viper.GetString("logLevel"), viper.GetString("logFormat"))
+	if err != nil {
+		logging.Fatal(logger, "failed to set up logging", logging.Err(err))
+	}
+
+	if cfgFile != "" {
+		logger.Info("loaded config file", slog.String("path", viper.ConfigFileUsed()))
 	}
 }
 
 func main() {
 	if err := rootCmd.Execute(); err != nil {
-		log.Fatal("failed to execute root command:", err)
+		logging.Fatal(logger, "failed to execute root command", logging.Err(err))
 	}
 }
@@ -1,17 +1,27 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
 	"crypto/x509"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 
+	"github.com/samlior/tcp-reverse-proxy/pkg/admin"
 	"github.com/samlior/tcp-reverse-proxy/pkg/common"
+	"github.com/samlior/tcp-reverse-proxy/pkg/constant"
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+	"github.com/samlior/tcp-reverse-proxy/pkg/metrics"
+	"github.com/samlior/tcp-reverse-proxy/pkg/protocol"
 	reverse_proxy "github.com/samlior/tcp-reverse-proxy/pkg/reverse-proxy"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
+	logger = logging.New("main")
+
 	BuildTime string
 	GitCommit string
 
@@ -22,27 +32,132 @@ var (
 		Run: func(cmd *cobra.Command, args []string) {
 			serverCert := viper.GetString("serverCert")
 			authPrivateKey := viper.GetString("authPrivateKey")
-			serverAddress := viper.GetString("serverAddress")
-			groupId := viper.GetUint8("groupId")
+			clientCert := viper.GetString("clientCert")
+			clientKey := viper.GetString("clientKey")
+			serverAddresses := viper.GetStringSlice("serverAddress")
+			group := viper.GetString("group")
+			multiplex := viper.GetInt("multiplex")
+			minPoolSize := viper.GetInt("minPoolSize")
+			maxPoolSize := viper.GetInt("maxPoolSize")
+			dialTimeout := viper.GetDuration("dialTimeout")
+			maxBackoff := viper.GetDuration("maxBackoff")
+			weight := viper.GetUint16("weight")
+			connUploadLimit := parseLimit("connUploadLimit")
+			connDownloadLimit := parseLimit("connDownloadLimit")
+			allow := viper.GetStringSlice("allow")
+			allowlistFile := viper.GetString("allowlist")
+			proxyProtocol := viper.GetStringSlice("proxyProtocol")
+			metricsAddress := viper.GetString("metricsAddress")
+			adminAddress := viper.GetString("adminAddress")
+			adminToken := viper.GetString("adminToken")
 
-			serverCertBytes, err := os.ReadFile(serverCert)
+			if adminAddress != "" && adminToken == "" {
+				logging.Fatal(logger, "admin-token is required by the admin api")
+			}
+
+			if len(serverAddresses) == 0 {
+				logging.Fatal(logger, "server address is required")
+			}
+
+			if minPoolSize < 1 || maxPoolSize < minPoolSize {
+				logging.Fatal(logger, "invalid pool size, expected 1 <= min-pool-size <= max-pool-size")
+			}
+
+			// the deprecated numeric group id is the same as the group named after it
+			if viper.IsSet("groupId") {
+				group = viper.GetString("groupId")
+			}
+			err := protocol.ValidateGroup(group)
 			if err != nil {
-				log.Fatal("failed to read server certificate:", err)
+				logging.Fatal(logger, "invalid group", logging.Err(err))
 			}
-			authPrivateKeyBytes, err := os.ReadFile(authPrivateKey)
+
+			serverCertBytes, err := os.ReadFile(serverCert)
 			if err != nil {
-				log.Fatal("failed to read auth private key:", err)
+				logging.Fatal(logger, "failed to read server certificate", logging.Err(err))
+			}
+
+			// the auth private key is optional when we are authenticated by a client certificate
+			var authPrivateKeyBytes []byte
+			if clientCert == "" || viper.IsSet("authPrivateKey") {
+				authPrivateKeyBytes, err = os.ReadFile(authPrivateKey)
+				if err != nil {
+					logging.Fatal(logger, "failed to read auth private key", logging.Err(err))
+				}
+				if len(authPrivateKeyBytes) != ed25519.PrivateKeySize {
+					logging.Fatal(logger, "invalid auth private key size", slog.Int("size", len(authPrivateKeyBytes)))
+				}
 			}
 
 			certPool := x509.NewCertPool()
 			if !certPool.AppendCertsFromPEM(serverCertBytes) {
-				log.Fatal("failed to append server certificate to cert pool")
+				logging.Fatal(logger, "failed to append server certificate to cert pool")
 			}
 
-			reverseProxyServer := reverse_proxy.NewReverseProxyServer(groupId, serverAddress, authPrivateKeyBytes, certPool)
+			tlsConfig := &tls.Config{
+				RootCAs: certPool,
+			}
+			if clientCert != "" {
+				cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+				if err != nil {
+					logging.Fatal(logger, "failed to load client certificate", logging.Err(err))
+				}
+				tlsConfig.Certificates = []tls.Certificate{cert}
+			}
+
+			if allowlistFile != "" {
+				rules, err := reverse_proxy.LoadAllowlist(allowlistFile)
+				if err != nil {
+					logging.Fatal(logger, "failed to read allowlist", logging.Err(err))
+				}
+				allow = append(allow, rules...)
+			}
+
+			var allowlist *reverse_proxy.Allowlist
+			if len(allow) > 0 {
+				allowlist, err = reverse_proxy.NewAllowlist(allow)
+				if err != nil {
+					logging.Fatal(logger, "failed to parse allowlist", logging.Err(err))
+				}
+				logger.Info("loaded allowlist rules", slog.Int("rules", allowlist.Len()))
+			} else {
+				logger.Warn("no allowlist configured, every destination is allowed")
+			}
+
+			var proxyProtocolRules *reverse_proxy.ProxyProtocol
+			if len(proxyProtocol) > 0 {
+				proxyProtocolRules, err = reverse_proxy.NewProxyProtocol(proxyProtocol)
+				if err != nil {
+					logging.Fatal(logger, "failed to parse proxy protocol rules", logging.Err(err))
+				}
+				logger.Info("loaded proxy protocol rules", slog.Int("rules", proxyProtocolRules.Len()))
+			}
+
+			reverseProxyServer := reverse_proxy.NewReverseProxyServer(group, serverAddresses, authPrivateKeyBytes, tlsConfig, multiplex, minPoolSize, maxPoolSize, allowlist)
+
+			reverseProxyServer.Weight = weight
+			reverseProxyServer.DialTimeout = dialTimeout
+			reverseProxyServer.MaxBackoff = maxBackoff
+			reverseProxyServer.ConnUploadLimit = connUploadLimit
+			reverseProxyServer.ConnDownloadLimit = connDownloadLimit
+			reverseProxyServer.ProxyProtocol = proxyProtocolRules
 
 			go common.HandleSignal(reverseProxyServer)
 
+			if metricsAddress != "" {
+				logger.Info("serving metrics", slog.String("address", metricsAddress))
+				go func() {
+					logging.Fatal(logger, "failed to serve metrics", logging.Err(metrics.Serve(metricsAddress, reverseProxyServer.Collector())))
+				}()
+			}
+
+			if adminAddress != "" {
+				logger.Info("serving the admin api", slog.String("address", adminAddress))
+				go func() {
+					logging.Fatal(logger, "failed to serve the admin api", logging.Err(admin.Serve(adminAddress, reverseProxyServer.CommonServer, adminToken)))
+				}()
+			}
+
 			go reverseProxyServer.KeepDialing()
 
 			select {}
@@ -53,7 +168,7 @@ var (
 		Use:   "version",
 		Short: "Show version",
 		Run: func(cmd *cobra.Command, args []string) {
-			log.Printf("tcp-reverse-proxy/reverse-proxy\n  build time: %s +0\n  git commit: %s\n", BuildTime, GitCommit)
+			fmt.Printf("tcp-reverse-proxy/reverse-proxy\n  build time: %s +0\n  git commit: %s\n", BuildTime, GitCommit)
 		},
 	}
 )
@@ -63,35 +178,94 @@ func init() {
 
 	rootCmd.Flags().StringP("server-cert", "c", "cert/server.crt", "server certificate path")
 	rootCmd.Flags().StringP("auth-private-key", "a", "cert/auth", "auth private key path")
-	rootCmd.Flags().StringP("server-address", "s", "localhost:4433", "server address")
-	rootCmd.Flags().Uint8P("group-id", "g", 0, "group id")
+	rootCmd.Flags().String("client-cert", "", "client certificate path (optional, authenticates with mutual tls)")
+	rootCmd.Flags().String("client-key", "cert/client.key", "client certificate key path")
+	rootCmd.Flags().StringSliceP("server-address", "s", []string{"localhost:4433"}, "relay server addresses in order of preference, separated by commas")
+	rootCmd.Flags().StringP("group", "g", "0", "group name, only the entry-point and reverse-proxy of the same group are connected")
+	rootCmd.Flags().Uint8("group-id", 0, "group id")
+	rootCmd.Flags().MarkDeprecated("group-id", "use --group instead")
+	rootCmd.Flags().StringSlice("allow", []string{}, "allowed destinations, separated by commas")
+	rootCmd.Flags().String("allowlist", "", "allowlist file path, one allowed destination per line")
+	rootCmd.Flags().StringSlice("proxy-protocol", []string{}, "tcp destinations which receive a PROXY protocol header with the client address, separated by commas, each optionally prefixed by v1= or v2=")
+	rootCmd.Flags().IntP("multiplex", "m", 0, "number of multiplexed sessions to the relay server (0 disables multiplexing)")
+	rootCmd.Flags().Int("min-pool-size", constant.DefaultMinPoolSize, "minimum number of idle connections to the relay server")
+	rootCmd.Flags().Int("max-pool-size", constant.DefaultMaxPoolSize, "maximum number of idle connections to the relay server, the pool grows when connections are consumed quickly")
+	rootCmd.Flags().Duration("dial-timeout", constant.DialTimeout, "maximum time allowed to connect to a relay server")
+	rootCmd.Flags().Duration("max-backoff", constant.RelayBackoffMax, "maximum time to wait before dialing a relay server again after it failed")
+	rootCmd.Flags().Uint16("weight", 1, "relative share of the connections of the group, used by the weighted balancer of the relay server")
+	rootCmd.Flags().String("conn-upload-limit", "0", "upload bandwidth of every session in bytes per second, with an optional K, M or G suffix (0 means unlimited)")
+	rootCmd.Flags().String("conn-download-limit", "0", "download bandwidth of every session in bytes per second, with an optional K, M or G suffix (0 means unlimited)")
+
+	rootCmd.Flags().String("metrics-address", "", "address to serve prometheus metrics on at /metrics, like 127.0.0.1:9100 (disabled if empty)")
+	rootCmd.Flags().String("admin-address", "", "address to serve the admin api on, a loopback address like 127.0.0.1:9200 or a unix socket like unix:/run/admin.sock (disabled if empty)")
+	rootCmd.Flags().String("admin-token", "", "bearer token required by the admin api")
+	rootCmd.Flags().String("log-level", "info", "log level: debug, info, warn or error")
+	rootCmd.Flags().String("log-format", logging.FormatText, "log format: text or json")
 
 	rootCmd.AddCommand(versionCmd)
 
 	viper.BindPFlag("serverCert", rootCmd.Flags().Lookup("server-cert"))
 	viper.BindPFlag("authPrivateKey", rootCmd.Flags().Lookup("auth-private-key"))
+	viper.BindPFlag("clientCert", rootCmd.Flags().Lookup("client-cert"))
+	viper.BindPFlag("clientKey", rootCmd.Flags().Lookup("client-key"))
 	viper.BindPFlag("serverAddress", rootCmd.Flags().Lookup("server-address"))
+	viper.BindPFlag("group", rootCmd.Flags().Lookup("group"))
 	viper.BindPFlag("groupId", rootCmd.Flags().Lookup("group-id"))
+	viper.BindPFlag("multiplex", rootCmd.Flags().Lookup("multiplex"))
+	viper.BindPFlag("minPoolSize", rootCmd.Flags().Lookup("min-pool-size"))
+	viper.BindPFlag("maxPoolSize", rootCmd.Flags().Lookup("max-pool-size"))
+	viper.BindPFlag("dialTimeout", rootCmd.Flags().Lookup("dial-timeout"))
+	viper.BindPFlag("maxBackoff", rootCmd.Flags().Lookup("max-backoff"))
+	viper.BindPFlag("weight", rootCmd.Flags().Lookup("weight"))
+	viper.BindPFlag("connUploadLimit", rootCmd.Flags().Lookup("conn-upload-limit"))
+	viper.BindPFlag("connDownloadLimit", rootCmd.Flags().Lookup("conn-download-limit"))
+	viper.BindPFlag("allow", rootCmd.Flags().Lookup("allow"))
+	viper.BindPFlag("allowlist", rootCmd.Flags().Lookup("allowlist"))
+	viper.BindPFlag("proxyProtocol", rootCmd.Flags().Lookup("proxy-protocol"))
+
+	viper.BindPFlag("metricsAddress", rootCmd.Flags().Lookup("metrics-address"))
+	viper.BindPFlag("adminAddress", rootCmd.Flags().Lookup("admin-address"))
+	viper.BindPFlag("adminToken", rootCmd.Flags().Lookup("admin-token"))
+	viper.BindPFlag("logLevel", rootCmd.Flags().Lookup("log-level"))
+	viper.BindPFlag("logFormat", rootCmd.Flags().Lookup("log-format"))
 
 	viper.AutomaticEnv()
 
 	cobra.OnInitialize(initConfig)
 }
 
+// parseLimit parses the bandwidth limit of the option
+func parseLimit(key string) int {
+	limit, err := common.ParseBandwidth(viper.GetString(key))
+	if err != nil {
+		logging.Fatal(logger, "invalid bandwidth limit", logging.Err(err))
+	}
+	return limit
+}
+
 func initConfig() {
 	cfgFile, _ := rootCmd.Flags().GetString("config")
 	if cfgFile != "" {
 		viper.SetConfigFile(cfgFile)
 		err := viper.ReadInConfig()
 		if err != nil {
-			log.Fatal("failed to read config file:", err)
+			logging.Fatal(logger, "failed to read config file", logging.Err(err))
 		}
-		log.Println("loaded config file:", viper.ConfigFileUsed())
+	}
+
+	// the logs are set up once the config file has been read
+	err := logging.Setup(viper.GetString("logLevel"), viper.GetString("logFormat"))
+	if err != nil {
+		logging.Fatal(logger, "failed to set up logging", logging.Err(err))
+	}
+
+	if cfgFile != "" {
+		logger.Info("loaded config file", slog.String("path", viper.ConfigFileUsed()))
 	}
 }
 
 func main() {
 	if err := rootCmd.Execute(); err != nil {
-		log.Fatal("failed to execute root command:", err)
+		logging.Fatal(logger, "failed to execute root command", logging.Err(err))
 	}
 }
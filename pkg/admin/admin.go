@@ -0,0 +1,135 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/samlior/tcp-reverse-proxy/pkg/common"
+)
+
+// Listen listens on a unix socket given as unix:PATH, or on a loopback tcp address,
+// the admin api is never exposed to the network
+func Listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		// remove the socket left by a previous run
+		if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+			os.Remove(path)
+		}
+
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		err = os.Chmod(path, 0o600)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("the admin api must listen on a loopback address or a unix socket: %s", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// Handler serves the admin api of the server, every request must carry the token as a bearer token:
+//
+//	GET    /connections                    lists the live connections, optionally filtered by ?group= and ?identity=
+//	DELETE /connections/{id}               resets a connection
+//	DELETE /connections?group=GROUP        resets every connection of a group
+//	DELETE /connections?identity=IDENTITY  resets every connection authenticated by an identity
+func Handler(server *common.CommonServer, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		group := r.URL.Query().Get("group")
+		identity := r.URL.Query().Get("identity")
+
+		connections := []common.ConnInfo{}
+		for _, conn := range server.Connections() {
+			if (group == "" || conn.Group == group) && (identity == "" || conn.Identity == identity) {
+				connections = append(connections, conn)
+			}
+		}
+		writeJSON(w, http.StatusOK, connections)
+	})
+
+	mux.HandleFunc("DELETE /connections/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid connection id"))
+			return
+		}
+		if !server.Kill(id) {
+			writeError(w, http.StatusNotFound, errors.New("connection not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"killed": 1})
+	})
+
+	mux.HandleFunc("DELETE /connections", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		// every connection is never killed at once by mistake
+		var killed int
+		switch {
+		case query.Has("group") && !query.Has("identity"):
+			killed = server.KillGroup(query.Get("group"))
+		case query.Has("identity") && !query.Has("group"):
+			killed = server.KillIdentity(query.Get("identity"))
+		default:
+			writeError(w, http.StatusBadRequest, errors.New("either a group or an identity is required"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"killed": killed})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Serve serves the admin api of the server on the address until it fails
+func Serve(address string, server *common.CommonServer, token string) error {
+	if token == "" {
+		return errors.New("a token is required by the admin api")
+	}
+
+	listener, err := Listen(address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	return http.Serve(listener, Handler(server, token))
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,324 @@
+package common
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	constant "github.com/samlior/tcp-reverse-proxy/pkg/constant"
+)
+
+const (
+	// the oldest pending connection is chosen
+	BalancerFirst = "first"
+	// peers take turns
+	BalancerRoundRobin = "round-robin"
+	// the peer with the fewest connected connections is chosen,
+	// the relay server only connects the connections which carry a session
+	BalancerLeastActive = "least-active"
+	// peers take turns in proportion to their weights
+	BalancerWeighted = "weighted"
+	// connections of the same client address are sent to the same peer,
+	// as long as it has idle connections
+	BalancerAffinity = "affinity"
+)
+
+// Balancer chooses the partner of a connection among the pending connections of the other side,
+// connections are grouped by their Peer so that a peer with many idle connections is not favoured.
+// All methods are called with the server lock held
+type Balancer interface {
+	// Select returns the candidate to connect conn with,
+	// candidates are the oldest pending connection of every peer, oldest first,
+	// and there are at least two of them
+	Select(conn *Conn, candidates []*Conn) *Conn
+	// Added is called when a connection is registered to be connected, before it is selected or selects
+	Added(conn *Conn)
+	// Connected is called when two connections have been connected
+	Connected(conn *Conn, another *Conn)
+	// Disconnected is called when a connected connection is closed
+	Disconnected(conn *Conn)
+	// Removed is called when a registered connection is closed, after Disconnected if it was connected
+	Removed(conn *Conn)
+}
+
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case BalancerFirst:
+		return nil, nil
+	case BalancerRoundRobin:
+		return &roundRobinBalancer{last: make(map[balancerKey]string)}, nil
+	case BalancerLeastActive:
+		return &leastActiveBalancer{active: make(map[balancerKey]map[string]int)}, nil
+	case BalancerWeighted:
+		return &weightedBalancer{
+			current: make(map[balancerKey]map[string]int),
+			conns:   make(map[balancerKey]map[string]int),
+		}, nil
+	case BalancerAffinity:
+		return &affinityBalancer{peers: make(map[balancerKey]map[string]int)}, nil
+	default:
+		return nil, fmt.Errorf("unknown balancer: %s", name)
+	}
+}
+
+// the state of a balancer is kept for every group and direction
+type balancerKey struct {
+	group    string
+	connType string
+}
+
+func keyOf(conn *Conn) balancerKey {
+	return balancerKey{conn.Group, conn.Type}
+}
+
+type roundRobinBalancer struct {
+	// last chosen peer of every group and direction
+	last map[balancerKey]string
+}
+
+func (b *roundRobinBalancer) Select(conn *Conn, candidates []*Conn) *Conn {
+	last := b.last[keyOf(conn)]
+
+	// the peer after the last chosen one in the order of their names, or the first one once we went round,
+	// peers which went away or came back do not break the order
+	var first, next *Conn
+	for _, candidate := range candidates {
+		if first == nil || candidate.Peer < first.Peer {
+			first = candidate
+		}
+		if candidate.Peer > last && (next == nil || candidate.Peer < next.Peer) {
+			next = candidate
+		}
+	}
+
+	selected := next
+	if selected == nil {
+		selected = first
+	}
+
+	b.last[keyOf(conn)] = selected.Peer
+	return selected
+}
+
+func (b *roundRobinBalancer) Added(conn *Conn) {}
+
+func (b *roundRobinBalancer) Connected(conn *Conn, another *Conn) {}
+
+func (b *roundRobinBalancer) Disconnected(conn *Conn) {}
+
+func (b *roundRobinBalancer) Removed(conn *Conn) {}
+
+type leastActiveBalancer struct {
+	// number of connected connections of every peer of every group and direction, keyed by the side of the peers
+	active map[balancerKey]map[string]int
+}
+
+func (b *leastActiveBalancer) Select(conn *Conn, candidates []*Conn) *Conn {
+	active := b.active[keyOf(candidates[0])]
+
+	var selected *Conn
+	for _, candidate := range candidates {
+		if selected == nil || active[candidate.Peer] < active[selected.Peer] {
+			selected = candidate
+		}
+	}
+	return selected
+}
+
+func (b *leastActiveBalancer) Added(conn *Conn) {}
+
+func (b *leastActiveBalancer) Connected(conn *Conn, another *Conn) {
+	for _, c := range []*Conn{conn, another} {
+		active, ok := b.active[keyOf(c)]
+		if !ok {
+			active = make(map[string]int)
+			b.active[keyOf(c)] = active
+		}
+		active[c.Peer]++
+	}
+}
+
+func (b *leastActiveBalancer) Disconnected(conn *Conn) {
+	key := keyOf(conn)
+	active := b.active[key]
+	active[conn.Peer]--
+	if active[conn.Peer] > 0 {
+		return
+	}
+
+	delete(active, conn.Peer)
+	if len(active) == 0 {
+		delete(b.active, key)
+	}
+}
+
+func (b *leastActiveBalancer) Removed(conn *Conn) {}
+
+// weightedBalancer implements the smooth weighted round robin,
+// so that a heavy peer does not receive all of its share in a row
+type weightedBalancer struct {
+	// current weight of every peer of every group and direction, keyed by the side of the peers
+	current map[balancerKey]map[string]int
+	// number of registered connections of every peer,
+	// the current weight of a peer is forgotten once it has no connection left
+	conns map[balancerKey]map[string]int
+}
+
+func (b *weightedBalancer) Select(conn *Conn, candidates []*Conn) *Conn {
+	key := keyOf(candidates[0])
+	current, ok := b.current[key]
+	if !ok {
+		current = make(map[string]int)
+		b.current[key] = current
+	}
+
+	var selected *Conn
+	total := 0
+	for _, candidate := range candidates {
+		weight := candidate.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		current[candidate.Peer] += weight
+
+		if selected == nil || current[candidate.Peer] > current[selected.Peer] {
+			selected = candidate
+		}
+	}
+
+	current[selected.Peer] -= total
+	return selected
+}
+
+func (b *weightedBalancer) Added(conn *Conn) {
+	conns, ok := b.conns[keyOf(conn)]
+	if !ok {
+		conns = make(map[string]int)
+		b.conns[keyOf(conn)] = conns
+	}
+	conns[conn.Peer]++
+}
+
+func (b *weightedBalancer) Connected(conn *Conn, another *Conn) {}
+
+func (b *weightedBalancer) Disconnected(conn *Conn) {}
+
+func (b *weightedBalancer) Removed(conn *Conn) {
+	key := keyOf(conn)
+	conns := b.conns[key]
+	conns[conn.Peer]--
+	if conns[conn.Peer] > 0 {
+		return
+	}
+
+	delete(conns, conn.Peer)
+	if len(conns) == 0 {
+		delete(b.conns, key)
+	}
+	if current, ok := b.current[key]; ok {
+		delete(current, conn.Peer)
+		if len(current) == 0 {
+			delete(b.current, key)
+		}
+	}
+}
+
+// affinityBalancer sends the connections of a client to the same reverse-proxy,
+// it uses rendezvous hashing so that only the connections of a peer which went away are moved
+type affinityBalancer struct {
+	// number of registered connections of every peer of every group and direction,
+	// an upstream connection looks for a session which prefers its peer among them
+	peers map[balancerKey]map[string]int
+}
+
+func (b *affinityBalancer) Select(conn *Conn, candidates []*Conn) *Conn {
+	if conn.Type == constant.ConnTypeDown {
+		return preferredBy(clientIP(conn), candidates)
+	}
+
+	// the oldest session which prefers the peer of the upstream connection,
+	// or the oldest session if none does
+	peers := b.peers[keyOf(conn)]
+	for _, candidate := range candidates {
+		ip := clientIP(candidate)
+
+		var preferred string
+		var preferredScore uint64
+		for peer := range peers {
+			score := affinityScore(ip, peer)
+			if preferred == "" || score > preferredScore {
+				preferred = peer
+				preferredScore = score
+			}
+		}
+		if preferred == conn.Peer {
+			return candidate
+		}
+	}
+	return candidates[0]
+}
+
+// preferredBy returns the upstream candidate with the highest score for the client
+func preferredBy(ip string, candidates []*Conn) *Conn {
+	var selected *Conn
+	var selectedScore uint64
+	for _, candidate := range candidates {
+		score := affinityScore(ip, candidate.Peer)
+		if selected == nil || score > selectedScore {
+			selected = candidate
+			selectedScore = score
+		}
+	}
+	return selected
+}
+
+// clientIP returns the address of the client of a downstream connection,
+// the relay server knows the client from the route,
+// the address of the entry-point is used if the entry-point does not send it
+func clientIP(conn *Conn) string {
+	if conn.Source.Host != "" {
+		return conn.Source.Host
+	}
+
+	ip := conn.Conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+func affinityScore(ip string, peer string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(ip))
+	hash.Write([]byte{0})
+	hash.Write([]byte(peer))
+	return hash.Sum64()
+}
+
+func (b *affinityBalancer) Added(conn *Conn) {
+	peers, ok := b.peers[keyOf(conn)]
+	if !ok {
+		peers = make(map[string]int)
+		b.peers[keyOf(conn)] = peers
+	}
+	peers[conn.Peer]++
+}
+
+func (b *affinityBalancer) Connected(conn *Conn, another *Conn) {}
+
+func (b *affinityBalancer) Disconnected(conn *Conn) {}
+
+func (b *affinityBalancer) Removed(conn *Conn) {
+	key := keyOf(conn)
+	peers := b.peers[key]
+	peers[conn.Peer]--
+	if peers[conn.Peer] > 0 {
+		return
+	}
+
+	delete(peers, conn.Peer)
+	if len(peers) == 0 {
+		delete(b.peers, key)
+	}
+}
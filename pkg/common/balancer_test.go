@@ -0,0 +1,109 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	constant "github.com/samlior/tcp-reverse-proxy/pkg/constant"
+)
+
+func TestWeightedBalancerForgetsPeersWithoutConnections(t *testing.T) {
+	balancer, err := NewBalancer(BalancerWeighted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weighted := balancer.(*weightedBalancer)
+
+	conn := &Conn{Type: constant.ConnTypeDown, Group: "g"}
+	a1 := &Conn{Type: constant.ConnTypeUp, Group: "g", Peer: "a", Weight: 2}
+	a2 := &Conn{Type: constant.ConnTypeUp, Group: "g", Peer: "a", Weight: 2}
+	b1 := &Conn{Type: constant.ConnTypeUp, Group: "g", Peer: "b", Weight: 1}
+	for _, c := range []*Conn{a1, a2, b1} {
+		balancer.Added(c)
+	}
+
+	balancer.Select(conn, []*Conn{a1, b1})
+	key := keyOf(a1)
+	if len(weighted.current[key]) != 2 {
+		t.Fatalf("expected the current weights of 2 peers, got %v", weighted.current[key])
+	}
+
+	// a still has a connection
+	balancer.Removed(a1)
+	balancer.Removed(b1)
+	if _, ok := weighted.current[key]["a"]; !ok {
+		t.Fatal("the current weight of a peer with connections has been forgotten")
+	}
+	if _, ok := weighted.current[key]["b"]; ok {
+		t.Fatal("the current weight of a peer without connections has been kept")
+	}
+
+	balancer.Removed(a2)
+	if len(weighted.current) != 0 || len(weighted.conns) != 0 {
+		t.Fatalf("expected no state left, got %v %v", weighted.current, weighted.conns)
+	}
+}
+
+func TestLeastActiveBalancerCountsEveryGroupApart(t *testing.T) {
+	balancer, err := NewBalancer(BalancerLeastActive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a is busy in group h, which must not count in group g
+	for range 3 {
+		down := &Conn{Type: constant.ConnTypeDown, Group: "h", Peer: "ep"}
+		up := &Conn{Type: constant.ConnTypeUp, Group: "h", Peer: "a"}
+		balancer.Connected(down, up)
+	}
+	down := &Conn{Type: constant.ConnTypeDown, Group: "g", Peer: "ep"}
+	b := &Conn{Type: constant.ConnTypeUp, Group: "g", Peer: "b"}
+	balancer.Connected(down, b)
+
+	a1 := &Conn{Type: constant.ConnTypeUp, Group: "g", Peer: "a"}
+	b1 := &Conn{Type: constant.ConnTypeUp, Group: "g", Peer: "b"}
+	conn := &Conn{Type: constant.ConnTypeDown, Group: "g", Peer: "ep"}
+	if selected := balancer.Select(conn, []*Conn{b1, a1}); selected != a1 {
+		t.Fatalf("expected the idle peer a of group g, got %s", selected.Peer)
+	}
+
+	balancer.Disconnected(b)
+	balancer.Disconnected(down)
+	if _, ok := balancer.(*leastActiveBalancer).active[keyOf(b)]; ok {
+		t.Fatal("the counts of a group without connections have been kept")
+	}
+}
+
+func TestAffinityBalancerAppliesToBothSides(t *testing.T) {
+	balancer, err := NewBalancer(BalancerAffinity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Conn{Type: constant.ConnTypeUp, Group: "g", Peer: "a"}
+	b := &Conn{Type: constant.ConnTypeUp, Group: "g", Peer: "b"}
+	balancer.Added(a)
+	balancer.Added(b)
+
+	// find a client which prefers a and one which prefers b
+	var preferA, preferB *Conn
+	for i := 0; preferA == nil || preferB == nil; i++ {
+		session := &Conn{Type: constant.ConnTypeDown, Group: "g"}
+		session.Source.Host = fmt.Sprintf("10.0.0.%d", i)
+		if balancer.Select(session, []*Conn{a, b}) == a {
+			preferA = session
+		} else {
+			preferB = session
+		}
+	}
+
+	// an upstream connection takes the session which prefers its peer, whatever their order
+	for _, candidates := range [][]*Conn{{preferA, preferB}, {preferB, preferA}} {
+		if selected := balancer.Select(a, candidates); selected != preferA {
+			t.Fatalf("expected the session of %s for peer a, got %s", preferA.Source.Host, selected.Source.Host)
+		}
+		if selected := balancer.Select(b, candidates); selected != preferB {
+			t.Fatalf("expected the session of %s for peer b, got %s", preferB.Source.Host, selected.Source.Host)
+		}
+	}
+}
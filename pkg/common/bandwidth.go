@@ -0,0 +1,319 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	constant "github.com/samlior/tcp-reverse-proxy/pkg/constant"
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+	"golang.org/x/time/rate"
+)
+
+var bandwidthLogger = logging.New("bandwidth")
+
+// Bandwidth caps the throughput of the data forwarded in one direction with a token bucket,
+// it is shared by all the connections it applies to and measures their current rate
+type Bandwidth struct {
+	// bytes per second, zero means unlimited
+	limit   int
+	limiter *rate.Limiter
+
+	// bytes forwarded since the start
+	total atomic.Uint64
+
+	lock         sync.Mutex
+	rate         float64
+	sampledAt    time.Time
+	sampledTotal uint64
+}
+
+func NewBandwidth(limit int) *Bandwidth {
+	b := &Bandwidth{
+		limit:     limit,
+		sampledAt: time.Now(),
+	}
+	if limit > 0 {
+		// the burst is at most one buffer, so that a limited connection does not stall the others
+		b.limiter = rate.NewLimiter(rate.Limit(limit), min(limit, constant.BufferSize))
+	}
+	return b
+}
+
+// Limit returns the limit in bytes per second, zero means unlimited
+func (b *Bandwidth) Limit() int {
+	return b.limit
+}
+
+// Total returns the number of bytes forwarded
+func (b *Bandwidth) Total() uint64 {
+	return b.total.Load()
+}
+
+// Rate returns the throughput in bytes per second,
+// averaged since the previous call and at least over a second
+func (b *Bandwidth) Rate() float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(b.sampledAt)
+	if elapsed >= time.Second {
+		total := b.total.Load()
+		b.rate = float64(total-b.sampledTotal) / elapsed.Seconds()
+		b.sampledAt = now
+		b.sampledTotal = total
+	}
+	return b.rate
+}
+
+// burst returns the largest read allowed at once
+func (b *Bandwidth) burst() int {
+	if b.limiter == nil {
+		return constant.BufferSize
+	}
+	return b.limiter.Burst()
+}
+
+// wait accounts n forwarded bytes and waits until the limit allows them,
+// it returns early with an error once done is closed
+func (b *Bandwidth) wait(n int, done <-chan struct{}) error {
+	b.total.Add(uint64(n))
+	if b.limiter == nil {
+		return nil
+	}
+
+	// a reservation can not exceed the burst
+	for n > 0 {
+		chunk := min(n, b.limiter.Burst())
+		n -= chunk
+
+		delay := b.limiter.ReserveN(time.Now(), chunk).Delay()
+		if delay == 0 {
+			continue
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return net.ErrClosed
+		}
+	}
+	return nil
+}
+
+// BandwidthLimit limits both directions of the sessions it applies to,
+// upload is the data sent by the clients of the entry-point and download the data sent back to them
+type BandwidthLimit struct {
+	Name     string
+	Upload   *Bandwidth
+	Download *Bandwidth
+}
+
+func NewBandwidthLimit(name string, upload int, download int) *BandwidthLimit {
+	return &BandwidthLimit{
+		Name:     name,
+		Upload:   NewBandwidth(upload),
+		Download: NewBandwidth(download),
+	}
+}
+
+func (l *BandwidthLimit) direction(upload bool) *Bandwidth {
+	if upload {
+		return l.Upload
+	}
+	return l.Download
+}
+
+// a group limit is removed once no connection of the group forwards data anymore
+type groupLimit struct {
+	*BandwidthLimit
+
+	refs int
+}
+
+// AddLimit registers a bandwidth limit so that its rate is reported
+func (cs *CommonServer) AddLimit(limit *BandwidthLimit) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	cs.limits = append(cs.limits, limit)
+}
+
+// BandwidthLimits returns the registered limits and the limits of the groups which forward data
+func (cs *CommonServer) BandwidthLimits() []*BandwidthLimit {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	limits := slices.Clone(cs.limits)
+	for _, limit := range cs.groupLimits {
+		limits = append(limits, limit.BandwidthLimit)
+	}
+	return limits
+}
+
+// LogBandwidth logs the rate of the bandwidth limits every interval, until the server is closed
+func (cs *CommonServer) LogBandwidth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cs.Closed:
+			return
+		case <-ticker.C:
+		}
+
+		for _, limit := range cs.BandwidthLimits() {
+			upload := limit.Upload.Rate()
+			download := limit.Download.Rate()
+			if upload == 0 && download == 0 {
+				continue
+			}
+			bandwidthLogger.Info("bandwidth", slog.String("limit", limit.Name), slog.String("upload", FormatBandwidth(upload)), slog.String("download", FormatBandwidth(download)))
+		}
+	}
+}
+
+// bandwidthsOf returns the bandwidths the data read from conn is subject to once connected to another,
+// release must be called once the data has been forwarded
+func (cs *CommonServer) bandwidthsOf(conn *Conn, another *Conn) ([]*Bandwidth, func()) {
+	upload := conn.Type == cs.ClientConnType
+
+	var bandwidths []*Bandwidth
+	for _, limit := range conn.Limits {
+		bandwidths = append(bandwidths, limit.direction(upload))
+	}
+	for _, limit := range another.Limits {
+		bandwidths = append(bandwidths, limit.direction(upload))
+	}
+
+	connLimit := cs.ConnDownloadLimit
+	if upload {
+		connLimit = cs.ConnUploadLimit
+	}
+	if connLimit > 0 {
+		bandwidths = append(bandwidths, NewBandwidth(connLimit))
+	}
+
+	if cs.GroupUploadLimit == 0 && cs.GroupDownloadLimit == 0 {
+		return bandwidths, func() {}
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	limit, ok := cs.groupLimits[conn.Group]
+	if !ok {
+		limit = &groupLimit{
+			BandwidthLimit: NewBandwidthLimit("group "+conn.Group, cs.GroupUploadLimit, cs.GroupDownloadLimit),
+		}
+		cs.groupLimits[conn.Group] = limit
+	}
+	limit.refs++
+
+	release := func() {
+		cs.lock.Lock()
+		defer cs.lock.Unlock()
+
+		limit.refs--
+		if limit.refs == 0 {
+			delete(cs.groupLimits, conn.Group)
+		}
+	}
+
+	return append(bandwidths, limit.direction(upload)), release
+}
+
+// limitedReader waits for its bandwidths after every read
+type limitedReader struct {
+	reader     io.Reader
+	bandwidths []*Bandwidth
+	done       <-chan struct{}
+	// a read never exceeds the burst of the bandwidths
+	maxRead int
+}
+
+func newLimitedReader(reader io.Reader, bandwidths []*Bandwidth, done <-chan struct{}) *limitedReader {
+	r := &limitedReader{
+		reader:     reader,
+		bandwidths: bandwidths,
+		done:       done,
+		maxRead:    constant.BufferSize,
+	}
+	for _, b := range bandwidths {
+		r.maxRead = min(r.maxRead, b.burst())
+	}
+	return r
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.maxRead {
+		p = p[:r.maxRead]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if err := r.account(n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (r *limitedReader) account(n int) error {
+	for _, b := range r.bandwidths {
+		if err := b.wait(n, r.done); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseBandwidth parses a limit in bytes per second,
+// it accepts the K, M and G suffixes as powers of 1024, zero means unlimited
+func ParseBandwidth(s string) (int, error) {
+	value := s
+	var multiplier uint64 = 1
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || n*multiplier > math.MaxInt {
+		return 0, fmt.Errorf("invalid bandwidth: %s", s)
+	}
+	return int(n * multiplier), nil
+}
+
+// FormatBandwidth formats a rate in bytes per second
+func FormatBandwidth(rate float64) string {
+	switch {
+	case rate >= 1<<30:
+		return fmt.Sprintf("%.1fG/s", rate/(1<<30))
+	case rate >= 1<<20:
+		return fmt.Sprintf("%.1fM/s", rate/(1<<20))
+	case rate >= 1<<10:
+		return fmt.Sprintf("%.1fK/s", rate/(1<<10))
+	default:
+		return fmt.Sprintf("%.0fB/s", rate)
+	}
+}
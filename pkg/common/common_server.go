@@ -1,52 +1,192 @@
 package common
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	constant "github.com/samlior/tcp-reverse-proxy/pkg/constant"
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+	"github.com/samlior/tcp-reverse-proxy/pkg/protocol"
 )
 
+var logger = logging.New("server")
+
 type Conn struct {
 	// unique id
 	Id uint64
 	// connection
 	Conn net.Conn
-	// data channel
+	// data channel, only used before the connection is connected
 	Ch chan []byte
 	// connection type
 	Type string
 	// connection status
 	Status int
 
-	// group id
-	GroupId uint8
+	// group, only connections of the same group are connected
+	Group string
+	// describes the route of the session, e.g. its destination, set once it is known
+	RouteName string
+	// name of the key which authenticated the connection,
+	// only set by the relay server
+	Identity string
+	// identifies the process on the other side of the connection,
+	// connections of the same peer are balanced as one, only set by the relay server
+	Peer string
+	// relative share of the connections the peer should receive
+	Weight int
 	// match id
 	// used to match upstream and downstream in the reverse proxy server
 	MatchId []byte
 	// route
-	// used to store the route information for the entry point server
+	// used to store the route information for the entry point server and the relay server
 	// it will be immediately written to the downstream after the connection is established
 	Route []byte
+	// the address of the client of the entry-point,
+	// only set by the relay server once the route has been received, empty if the entry-point does not send it
+	Source protocol.Address
+
+	// when the connection has been created
+	CreatedAt time.Time
+
+	// the connection has been accepted from a client,
+	// it waits for its partner as soon as it is registered
+	Client bool
+
+	// bandwidth limits shared by the session of the connection,
+	// they apply to both connections once connected
+	Limits []*BandwidthLimit
+
+	// data taken from the channel by Read but not consumed yet,
+	// it will be written to the downstream before anything else
+	buffered []byte
+	// closed when the server is closed
+	closed <-chan struct{}
+	// closed when the connection is removed
+	done chan struct{}
+	// closed when the connection has been read to the end
+	readFinished chan struct{}
+	// receives the connection the data should be forwarded to once connected
+	forwardTo chan *Conn
+	// the data has been read to the end and the other connection has been half-closed,
+	// set before readFinished is closed
+	halfClosed bool
+	// number of directions of the connection which ended gracefully, once connected
+	// it is closed gracefully when both have, and reset otherwise
+	ended atomic.Int32
+
+	// the connection it is connected to, set under the server lock
+	partner *Conn
+	// the connection is reset instead of closed gracefully once removed, set under the server lock
+	resetOnClose bool
+	// bytes read from the connection and forwarded to its partner
+	received atomic.Uint64
+
+	// the connection is counted in the wait queue
+	waiting      bool
+	waitingSince time.Time
+	waitTimer    *time.Timer
+
+	// set while the connection is in a pending queue
+	pending *PendingConnection
+	// the connection has been registered to be connected, the balancer has been told about it
+	registered bool
 }
 
-type PendingConnection struct {
-	conn      *Conn
-	anotherCh chan *Conn
+// LogAttrs describes the connection in the logs, followed by extra fields
+func (c *Conn) LogAttrs(args ...any) []any {
+	attrs := []any{
+		slog.Uint64(logging.KeyConnId, c.Id),
+		slog.String("type", c.Type),
+		slog.String(logging.KeyGroup, c.Group),
+		slog.String(logging.KeyRemoteAddr, c.Conn.RemoteAddr().String()),
+	}
+	if c.Peer != "" {
+		attrs = append(attrs, slog.String(logging.KeyPeerId, c.Peer))
+	}
+	if c.Identity != "" {
+		attrs = append(attrs, slog.String("identity", c.Identity))
+	}
+	if c.RouteName != "" {
+		attrs = append(attrs, slog.String(logging.KeyRoute, c.RouteName))
+	}
+	return append(attrs, args...)
+}
+
+// Read reads the data channel as a stream,
+// it should only be used before the connection is connected
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.buffered) == 0 {
+		select {
+		case <-c.closed:
+			return 0, errors.New("server closed")
+		case <-c.done:
+			return 0, net.ErrClosed
+		case data, ok := <-c.Ch:
+			if !ok {
+				return 0, io.EOF
+			}
+			c.buffered = data
+		}
+	}
+
+	n := copy(p, c.buffered)
+	c.buffered = c.buffered[n:]
+	return n, nil
 }
 
 type CommonServer struct {
 	Id uint64
 
+	// group of the connections which are not told their own,
+	// i.e. every connection of the entry-point and the reverse-proxy
+	Group string
+
 	OnConnClosed func(*Conn)
 	OnConnected  func(*Conn, *Conn)
 
-	PendingUpConnections   []*PendingConnection
-	PendingDownConnections []*PendingConnection
+	// chooses the partner of a connection, nil means the oldest pending connection
+	Balancer Balancer
+
+	// maximum number of connections waiting for a partner, zero means unlimited
+	MaxQueue int
+	// maximum number of connections of a group waiting for a partner, zero means unlimited
+	MaxQueuePerGroup int
+	// connections waiting longer than this for a partner are closed, zero means forever
+	MaxWait time.Duration
+	// reset the connections which are rejected or timed out instead of closing them gracefully
+	ResetOnReject bool
+
+	// number of connections rejected because the queue was full
+	Rejected atomic.Uint64
+	// number of connections closed after waiting for MaxWait
+	TimedOut atomic.Uint64
+
+	// type of the connections on the side of the clients of the entry-point,
+	// the data read from them is uploaded and the data read from the others downloaded
+	ClientConnType string
+	// bandwidth limits in bytes per second of every session, zero means unlimited
+	ConnUploadLimit   int
+	ConnDownloadLimit int
+	// bandwidth limits in bytes per second shared by the sessions of every group, zero means unlimited
+	GroupUploadLimit   int
+	GroupDownloadLimit int
+
+	waiting         int
+	waitingPerGroup map[string]int
+
+	// bandwidth limits which are not bound to a group, reported by LogBandwidth
+	limits      []*BandwidthLimit
+	groupLimits map[string]*groupLimit
+
+	PendingUpConnections   *pendingQueue
+	PendingDownConnections *pendingQueue
 
 	Closed chan struct{}
 
@@ -54,115 +194,223 @@ type CommonServer struct {
 	wg   sync.WaitGroup
 
 	connections map[uint64]*Conn
+	// connections removed under the lock, they are closed once it is released
+	removed []*Conn
 }
 
 func NewCommonServer() *CommonServer {
 	return &CommonServer{
 		Id:                     1,
-		PendingUpConnections:   make([]*PendingConnection, 0),
-		PendingDownConnections: make([]*PendingConnection, 0),
+		PendingUpConnections:   newPendingQueue(),
+		PendingDownConnections: newPendingQueue(),
 		connections:            make(map[uint64]*Conn),
+		waitingPerGroup:        make(map[string]int),
+		groupLimits:            make(map[string]*groupLimit),
 		Closed:                 make(chan struct{}),
 	}
 }
 
-func (cs *CommonServer) readDataFromConn(conn *Conn, readFinished chan struct{}) {
-	defer close(conn.Ch)
-	defer close(readFinished)
+// readDataFromConn reads the connection until it is connected,
+// then forwards the rest of its data directly to the other connection
+func (cs *CommonServer) readDataFromConn(conn *Conn) {
+	defer close(conn.readFinished)
 
-	buffer := make([]byte, 1024)
+	buffer := getBuffer()
+	defer putBuffer(buffer)
 
-	for {
-		length, err := conn.Conn.Read(buffer)
-		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-			// closed
-			return
+	another, data, readErr := cs.readUntilConnected(conn, *buffer)
+	if another == nil {
+		return
+	}
+
+	transferred := cs.transferredBytes(conn, another)
+
+	var src io.Reader = &countingReader{conn.Conn, transferred, &conn.received}
+	var limited *limitedReader
+	bandwidths, release := cs.bandwidthsOf(conn, another)
+	defer release()
+	if len(bandwidths) > 0 {
+		limited = newLimitedReader(src, bandwidths, conn.done)
+		src = limited
+	}
+
+	// the route and the data read before being connected are sent first,
+	// even if the session already ended, e.g. a client which half-closed without sending anything
+	var err error
+	chunks := [][]byte{conn.Route, conn.buffered, data}
+	conn.Route = nil
+	conn.buffered = nil
+	for i, chunk := range chunks {
+		if err != nil || len(chunk) == 0 {
+			continue
+		}
+		if limited != nil {
+			err = limited.account(len(chunk))
 		}
+		if err == nil {
+			_, err = another.Conn.Write(chunk)
+		}
+		// the route is not data of the session
+		if err == nil && i > 0 {
+			transferred.Add(float64(len(chunk)))
+			conn.received.Add(uint64(len(chunk)))
+		}
+	}
+
+	if err == nil {
+		err = readErr
+	}
+	if err == nil {
+		err = forward(another.Conn, src, *buffer)
+	}
+	conn.halfClosed = cs.finishForwarding(conn, another, err)
+}
+
+// readUntilConnected sends the data of the connection to its channel until it is connected,
+// it returns the connection to forward to with the data read in the meantime or the error which ended the reading,
+// another is nil if the connection has not been connected
+func (cs *CommonServer) readUntilConnected(conn *Conn, buffer []byte) (another *Conn, data []byte, err error) {
+	closeCh := sync.OnceFunc(func() { close(conn.Ch) })
+	defer closeCh()
+
+	for first := true; ; first = false {
+		length, err := conn.Conn.Read(buffer)
 		if err != nil {
-			log.Println("error reading from client:", err)
-			return
+			// a session which ended before being connected half-closes the other connection once connected,
+			// the channel is closed first so that nobody waits for more data
+			if errors.Is(err, io.EOF) && (conn.Client || !first) {
+				closeCh()
+				select {
+				case another := <-conn.forwardTo:
+					return another, nil, err
+				case <-conn.done:
+					return nil, nil, err
+				}
+			}
+
+			// it may have been connected while waiting for data
+			select {
+			case another := <-conn.forwardTo:
+				return another, nil, err
+			default:
+			}
+
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Warn("error reading from client", conn.LogAttrs(logging.Err(err))...)
+			}
+			return nil, nil, err
+		}
+
+		// the connection carries a session from now on
+		if first {
+			cs.startWaiting(conn)
 		}
 
 		// send data to channel
 		data := make([]byte, length)
 		copy(data, buffer[:length])
-		conn.Ch <- data
+		select {
+		case conn.Ch <- data:
+		case another := <-conn.forwardTo:
+			return another, data, nil
+		case <-conn.done:
+			return nil, nil, nil
+		}
 	}
 }
 
-func (cs *CommonServer) writeDataToConn(conn *Conn, ch <-chan []byte, writeFinished chan struct{}) {
-	defer close(writeFinished)
-
-	for data := range ch {
-		if data == nil {
-			log.Println("channel closed")
-			return
+// finishForwarding propagates the end of the data of conn to another,
+// the end of the stream as a half-close and an error as a reset of both sides.
+// It returns true if another has been half-closed and data can still flow the other way
+func (cs *CommonServer) finishForwarding(conn *Conn, another *Conn, err error) bool {
+	if err == nil || errors.Is(err, io.EOF) {
+		err = closeWrite(another.Conn)
+		if err == nil {
+			conn.ended.Add(1)
+			another.ended.Add(1)
+			return true
 		}
 
-		_, err := conn.Conn.Write(data)
-		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-			// closed
-			return
-		}
-		if err != nil {
-			log.Println("error writing to client:", err)
-			return
+		// the session ends with the data when it can not be half-closed, e.g. over udp
+		if errors.Is(err, errors.ErrUnsupported) {
+			conn.ended.Store(2)
+			another.ended.Store(2)
+			return false
 		}
 	}
+
+	// closed by ourselves
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+
+	logger.Warn("connection aborted", conn.LogAttrs(slog.Uint64("partner_id", another.Id), logging.Err(err))...)
+	setReset(conn.Conn)
+	setReset(another.Conn)
+	return false
 }
 
-func (cs *CommonServer) registerPendingConn(conn *Conn, anotherCh chan *Conn) {
+// registerPendingConn connects the connection to a pending connection of the other side,
+// or adds it to the pending queue, it returns false if the queue is full
+func (cs *CommonServer) registerPendingConn(conn *Conn, anotherCh chan *Conn) bool {
 	cs.lock.Lock()
-	defer cs.lock.Unlock()
+	defer cs.unlock()
 
-	var pendingConnections *[]*PendingConnection
-	var anotherPendingConnections *[]*PendingConnection
+	pendingConnections := cs.PendingDownConnections
+	anotherPendingConnections := cs.PendingUpConnections
 	if conn.Type == constant.ConnTypeUp {
-		pendingConnections = &cs.PendingUpConnections
-		anotherPendingConnections = &cs.PendingDownConnections
-	} else {
-		pendingConnections = &cs.PendingDownConnections
-		anotherPendingConnections = &cs.PendingUpConnections
-	}
-
-	if len(*anotherPendingConnections) > 0 {
-		// select the matching connection
-		var another *PendingConnection
-		var anotherIndex int
-		for i, p := range *anotherPendingConnections {
-			if conn.GroupId == p.conn.GroupId && (conn.MatchId == nil || bytes.Equal(p.conn.MatchId, conn.MatchId)) {
-				another = p
-				anotherIndex = i
-				break
-			}
-		}
+		pendingConnections, anotherPendingConnections = anotherPendingConnections, pendingConnections
+	}
 
-		if another != nil {
-			// remove the connection from the pending queue
-			*anotherPendingConnections = append((*anotherPendingConnections)[:anotherIndex], (*anotherPendingConnections)[anotherIndex+1:]...)
+	conn.registered = true
+	if cs.Balancer != nil {
+		cs.Balancer.Added(conn)
+	}
 
-			// update status
-			conn.Status = constant.ConnStatusConnected
-			another.conn.Status = constant.ConnStatusConnected
+	// select the matching connection
+	another := anotherPendingConnections.match(conn, cs.Balancer)
+	if another != nil {
+		// remove the connection from the pending queue
+		anotherPendingConnections.remove(another)
+		another.conn.pending = nil
+
+		cs.observePairingLocked(conn)
+		cs.observePairingLocked(another.conn)
+
+		// update status
+		cs.stopWaitingLocked(conn)
+		cs.stopWaitingLocked(another.conn)
+		conn.Status = constant.ConnStatusConnected
+		another.conn.Status = constant.ConnStatusConnected
+		conn.partner = another.conn
+		another.conn.partner = conn
+
+		// invoke callback
+		cs.onConnected(conn, another.conn)
+		if cs.Balancer != nil {
+			cs.Balancer.Connected(conn, another.conn)
+		}
 
-			// invoke callback
-			cs.onConnected(conn, another.conn)
+		// return the channel
+		anotherCh <- another.conn
+		another.anotherCh <- conn
 
-			// return the channel
-			anotherCh <- another.conn
-			another.anotherCh <- conn
+		logger.Info("connection connected", conn.LogAttrs(slog.Uint64("partner_id", another.conn.Id), slog.String("partner_remote_addr", another.conn.Conn.RemoteAddr().String()))...)
 
-			log.Printf("connection connected(%d): %d %s <-> %d %s\n", conn.GroupId, conn.Id, conn.Conn.RemoteAddr(), another.conn.Id, another.conn.Conn.RemoteAddr())
+		return true
+	}
 
-			return
-		}
+	if conn.Client && !cs.startWaitingLocked(conn) {
+		return false
 	}
 
 	// add it to the pending queue
-	*pendingConnections = append(*pendingConnections, &PendingConnection{
-		conn,
-		anotherCh,
-	})
+	conn.pending = &PendingConnection{
+		conn:      conn,
+		anotherCh: anotherCh,
+	}
+	pendingConnections.push(conn.pending)
+	return true
 }
 
 func (cs *CommonServer) onConnClosed(conn *Conn) {
@@ -191,11 +439,17 @@ func (cs *CommonServer) newConn(netConn net.Conn, connType string) (*Conn, error
 	cs.Id++
 
 	conn := &Conn{
-		Id:     id,
-		Conn:   netConn,
-		Ch:     make(chan []byte),
-		Type:   connType,
-		Status: constant.ConnStatusPending,
+		Id:           id,
+		Conn:         netConn,
+		Ch:           make(chan []byte),
+		Type:         connType,
+		Status:       constant.ConnStatusPending,
+		Group:        cs.Group,
+		CreatedAt:    time.Now(),
+		closed:       cs.Closed,
+		done:         make(chan struct{}),
+		readFinished: make(chan struct{}),
+		forwardTo:    make(chan *Conn, 1),
 	}
 
 	// add to connections
@@ -206,28 +460,57 @@ func (cs *CommonServer) newConn(netConn net.Conn, connType string) (*Conn, error
 
 func (cs *CommonServer) removeConn(conn *Conn) {
 	cs.lock.Lock()
-	defer cs.lock.Unlock()
+	defer cs.unlock()
 
+	cs.removeConnLocked(conn)
+}
+
+// closePending closes the connection unless it has been connected to another one,
+// the check and the removal are atomic so that it can not be connected in between
+func (cs *CommonServer) closePending(conn *Conn) bool {
+	cs.lock.Lock()
+	defer cs.unlock()
+
+	if conn.Status != constant.ConnStatusPending {
+		return false
+	}
+
+	cs.removeConnLocked(conn)
+	return true
+}
+
+// removeConnLocked removes the connection, it is closed once the server lock is released by unlock
+func (cs *CommonServer) removeConnLocked(conn *Conn) {
 	if conn.Status == constant.ConnStatusClosed {
 		return
 	}
 
-	var pendingConnections *[]*PendingConnection
-	if conn.Type == constant.ConnTypeUp {
-		pendingConnections = &cs.PendingUpConnections
-	} else {
-		pendingConnections = &cs.PendingDownConnections
+	if conn.pending != nil {
+		pendingConnections := cs.PendingDownConnections
+		if conn.Type == constant.ConnTypeUp {
+			pendingConnections = cs.PendingUpConnections
+		}
+
+		conn.pending.anotherCh <- nil
+		pendingConnections.remove(conn.pending)
+		conn.pending = nil
 	}
 
-	for i, p := range *pendingConnections {
-		if p.conn == conn {
-			p.anotherCh <- nil
-			*pendingConnections = append((*pendingConnections)[:i], (*pendingConnections)[i+1:]...)
-			break
-		}
+	// the idle connections of the pools come and go
+	level := slog.LevelDebug
+	if conn.Status == constant.ConnStatusConnected {
+		level = slog.LevelInfo
 	}
+	logger.Log(context.Background(), level, "connection removed", conn.LogAttrs()...)
 
-	log.Printf("connection removed(%d): %d %s\n", conn.GroupId, conn.Id, conn.Conn.RemoteAddr())
+	cs.stopWaitingLocked(conn)
+
+	if cs.Balancer != nil && conn.Status == constant.ConnStatusConnected {
+		cs.Balancer.Disconnected(conn)
+	}
+	if cs.Balancer != nil && conn.registered {
+		cs.Balancer.Removed(conn)
+	}
 
 	// invoke callback
 	cs.onConnClosed(conn)
@@ -235,10 +518,32 @@ func (cs *CommonServer) removeConn(conn *Conn) {
 	// remove from connections
 	delete(cs.connections, conn.Id)
 
+	// a session which did not end gracefully is reset,
+	// otherwise closing the connection may read as the end of its data, e.g. a close_notify alert of tls
+	if conn.Status == constant.ConnStatusConnected && conn.ended.Load() < 2 {
+		conn.resetOnClose = true
+	}
+
 	// update status
 	conn.Status = constant.ConnStatusClosed
+	close(conn.done)
+
+	cs.removed = append(cs.removed, conn)
+}
+
+// unlock releases the server lock and closes the connections removed meanwhile,
+// closing a connection may block, e.g. on a backpressured session, so it is never done under the lock
+func (cs *CommonServer) unlock() {
+	removed := cs.removed
+	cs.removed = nil
+	cs.lock.Unlock()
 
-	conn.Conn.Close()
+	for _, conn := range removed {
+		if conn.resetOnClose {
+			setReset(conn.Conn)
+		}
+		conn.Conn.Close()
+	}
 }
 
 func (cs *CommonServer) HandleConnection(
@@ -249,7 +554,7 @@ func (cs *CommonServer) HandleConnection(
 	conn, err := cs.newConn(netConn, connType)
 	if err != nil {
 		netConn.Close()
-		log.Println("error creating connection:", err)
+		logger.Error("error creating connection", slog.String(logging.KeyRemoteAddr, netConn.RemoteAddr().String()), logging.Err(err))
 		return
 	}
 
@@ -258,55 +563,60 @@ func (cs *CommonServer) HandleConnection(
 
 	defer cs.removeConn(conn)
 
-	log.Printf("connection connected(%d): %d %s\n", conn.GroupId, conn.Id, conn.Conn.RemoteAddr())
-
-	readFinished := make(chan struct{})
-	writeFinished := make(chan struct{})
+	logger.Debug("connection opened", conn.LogAttrs()...)
 
-	go cs.readDataFromConn(conn, readFinished)
+	go cs.readDataFromConn(conn)
 
 	err = onInit(conn)
 	if err != nil {
 		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 			return
 		}
-		log.Println("error initializing connection:", err)
+		logger.Warn("error initializing connection", conn.LogAttrs(logging.Err(err))...)
 		return
 	}
 
-	log.Printf("connection initialized(%d): %d %s\n", conn.GroupId, conn.Id, conn.Conn.RemoteAddr())
+	logger.Debug("connection initialized", conn.LogAttrs()...)
 
 	anotherCh := make(chan *Conn, 1)
-	cs.registerPendingConn(conn, anotherCh)
+	if !cs.registerPendingConn(conn, anotherCh) {
+		return
+	}
 
+	var another *Conn
 	select {
 	case <-cs.Closed:
 		return
-	case <-readFinished:
+	case <-conn.readFinished:
 		return
-	case another := <-anotherCh:
+	case another = <-anotherCh:
 		if another == nil {
 			return
 		}
 
-		if another.Route != nil {
-			_, err := conn.Conn.Write(another.Route)
-			if err != nil {
-				log.Println("error writing route:", err)
+		// the other connection forwards its route and data itself
+		another.forwardTo <- conn
+	}
+
+	// wait until both directions are finished,
+	// or one of them could not be half-closed
+	readFinished := conn.readFinished
+	anotherReadFinished := another.readFinished
+	for readFinished != nil || anotherReadFinished != nil {
+		select {
+		case <-cs.Closed:
+			return
+		case <-readFinished:
+			if !conn.halfClosed {
 				return
 			}
-
-			// clear the route
-			another.Route = nil
+			readFinished = nil
+		case <-anotherReadFinished:
+			if !another.halfClosed {
+				return
+			}
+			anotherReadFinished = nil
 		}
-
-		go cs.writeDataToConn(conn, another.Ch, writeFinished)
-	}
-
-	select {
-	case <-cs.Closed:
-	case <-readFinished:
-	case <-writeFinished:
 	}
 }
 
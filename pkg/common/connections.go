@@ -0,0 +1,115 @@
+package common
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// ConnInfo describes a live connection
+type ConnInfo struct {
+	Id     uint64 `json:"id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Group  string `json:"group"`
+	// only set by the relay server
+	Identity   string `json:"identity,omitempty"`
+	Peer       string `json:"peer,omitempty"`
+	RemoteAddr string `json:"remoteAddr"`
+	Route      string `json:"route,omitempty"`
+	// zero until the connection is connected
+	PartnerId  uint64    `json:"partnerId,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	AgeSeconds float64   `json:"ageSeconds"`
+	// bytes read from the connection and written to it since it has been connected
+	BytesReceived uint64 `json:"bytesReceived"`
+	BytesSent     uint64 `json:"bytesSent"`
+}
+
+// Connections returns the live connections ordered by id
+func (cs *CommonServer) Connections() []ConnInfo {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	now := time.Now()
+	infos := make([]ConnInfo, 0, len(cs.connections))
+	for _, conn := range cs.connections {
+		info := ConnInfo{
+			Id:            conn.Id,
+			Type:          conn.Type,
+			Status:        statusName(conn.Status),
+			Group:         conn.Group,
+			Identity:      conn.Identity,
+			Peer:          conn.Peer,
+			RemoteAddr:    conn.Conn.RemoteAddr().String(),
+			Route:         conn.RouteName,
+			CreatedAt:     conn.CreatedAt,
+			AgeSeconds:    now.Sub(conn.CreatedAt).Seconds(),
+			BytesReceived: conn.received.Load(),
+		}
+		if conn.partner != nil {
+			info.PartnerId = conn.partner.Id
+			info.BytesSent = conn.partner.received.Load()
+			if info.Route == "" {
+				info.Route = conn.partner.RouteName
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b ConnInfo) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return infos
+}
+
+// Kill resets the connection with the id, it returns false if there is none
+func (cs *CommonServer) Kill(id uint64) bool {
+	cs.lock.Lock()
+	defer cs.unlock()
+
+	conn, ok := cs.connections[id]
+	if !ok {
+		return false
+	}
+
+	cs.killLocked(conn)
+	return true
+}
+
+// KillGroup resets every connection of the group and returns their number
+func (cs *CommonServer) KillGroup(group string) int {
+	return cs.killMatching(func(conn *Conn) bool {
+		return conn.Group == group
+	})
+}
+
+// KillIdentity resets every connection authenticated by the key or the certificate named identity,
+// and returns their number
+func (cs *CommonServer) KillIdentity(identity string) int {
+	return cs.killMatching(func(conn *Conn) bool {
+		return conn.Identity == identity
+	})
+}
+
+func (cs *CommonServer) killMatching(match func(conn *Conn) bool) int {
+	cs.lock.Lock()
+	defer cs.unlock()
+
+	killed := 0
+	for _, conn := range cs.connections {
+		if match(conn) {
+			cs.killLocked(conn)
+			killed++
+		}
+	}
+	return killed
+}
+
+// killLocked resets the connection, its partner is reset once it notices,
+// the server lock must be held
+func (cs *CommonServer) killLocked(conn *Conn) {
+	logger.Info("connection killed", conn.LogAttrs()...)
+	conn.resetOnClose = true
+	cs.removeConnLocked(conn)
+}
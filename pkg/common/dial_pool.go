@@ -0,0 +1,105 @@
+package common
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+)
+
+// the pairing rate used to size the pool halves every adjust interval without pairings
+const poolDecay = 0.5
+
+// dialPool sizes the pool of pending connections to the relay server,
+// it grows as soon as the pending connections are consumed faster than they are dialed
+// and shrinks back to its minimum size when they are not consumed anymore
+type dialPool struct {
+	lock sync.Mutex
+
+	minSize int
+	maxSize int
+	// expected number of dialing and pending connections
+	size int
+	// current number of dialing and pending connections
+	slots int
+
+	// pairings since the last adjustment
+	pairings int
+	// decaying maximum of the pairings of an adjust interval
+	rate float64
+
+	// notified whenever slots are released or the size grows
+	wake chan struct{}
+}
+
+func newDialPool(minSize int, maxSize int) *dialPool {
+	return &dialPool{
+		minSize: minSize,
+		maxSize: maxSize,
+		size:    minSize,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (p *dialPool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// acquire takes every free slot and returns how many connections should be dialed
+func (p *dialPool) acquire() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n := p.size - p.slots
+	if n <= 0 {
+		return 0
+	}
+	p.slots += n
+	return n
+}
+
+func (p *dialPool) release() {
+	p.lock.Lock()
+	p.slots--
+	p.lock.Unlock()
+
+	p.notify()
+}
+
+// paired is called whenever a pending connection is consumed,
+// the pool doubles once the pairings of the interval reach its size
+func (p *dialPool) paired() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.pairings++
+	if p.pairings >= p.size && p.size < p.maxSize {
+		p.resize(min(p.size*2, p.maxSize))
+		p.notify()
+	}
+}
+
+// adjust resizes the pool after the pairings of the last interval,
+// it returns how many pending connections exceed the new size
+func (p *dialPool) adjust() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// bursts larger than the pool do not delay the shrinking
+	p.rate = min(max(float64(p.pairings), p.rate*poolDecay), float64(p.maxSize))
+	p.pairings = 0
+
+	p.resize(max(p.minSize, int(math.Ceil(p.rate))))
+
+	return p.slots - p.size
+}
+
+func (p *dialPool) resize(size int) {
+	if size == p.size {
+		return
+	}
+	poolLogger.Info("pool size changed", slog.Int("from", p.size), slog.Int("to", size))
+	p.size = size
+}
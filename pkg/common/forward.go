@@ -0,0 +1,46 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	constant "github.com/samlior/tcp-reverse-proxy/pkg/constant"
+)
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, constant.BufferSize)
+		return &buffer
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(buffer *[]byte) {
+	bufferPool.Put(buffer)
+}
+
+// forward copies src to dst until src is closed.
+// The data is not spliced by the kernel: one side is always a tls connection or a multiplexed stream
+// to or from the relay server, and the data read may be subject to bandwidth limits
+func forward(dst net.Conn, src io.Reader, buffer []byte) error {
+	// hide ReadFrom and WriteTo so that the pooled buffer is used
+	_, err := io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buffer)
+	return err
+}
+
+// closeWrite half-closes the connection, so that the peer reads an eof but can still send data,
+// tcp sends a fin, tls a close_notify alert and multiplexed streams a fin frame
+func closeWrite(conn net.Conn) error {
+	switch c := conn.(type) {
+	case *relayConn:
+		return closeWrite(c.Conn)
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
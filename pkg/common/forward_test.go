@@ -0,0 +1,122 @@
+package common
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback tcp connection
+func tcpPair(b *testing.B) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, ok := <-accepted
+	if !ok {
+		b.Fatal("failed to accept")
+	}
+	return dialed, conn
+}
+
+// forwardThroughChannel is how the data was forwarded before,
+// every read was copied to a new slice and handed to a writing goroutine through a channel
+func forwardThroughChannel(dst net.Conn, src net.Conn) error {
+	ch := make(chan []byte)
+	writeFinished := make(chan error)
+	go func() {
+		for data := range ch {
+			if _, err := dst.Write(data); err != nil {
+				writeFinished <- err
+				return
+			}
+		}
+		writeFinished <- nil
+	}()
+
+	buffer := make([]byte, 1024)
+	for {
+		length, err := src.Read(buffer)
+		if err != nil {
+			close(ch)
+			if err == io.EOF {
+				return <-writeFinished
+			}
+			return err
+		}
+
+		data := make([]byte, length)
+		copy(data, buffer[:length])
+		ch <- data
+	}
+}
+
+// benchmarkForward measures the throughput of a forwarding function between two loopback tcp connections
+func benchmarkForward(b *testing.B, fn func(dst net.Conn, src net.Conn) error) {
+	const chunk = 32 * 1024
+
+	clientConn, srcConn := tcpPair(b)
+	dstConn, serverConn := tcpPair(b)
+	defer clientConn.Close()
+	defer srcConn.Close()
+	defer dstConn.Close()
+	defer serverConn.Close()
+
+	b.SetBytes(chunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		data := make([]byte, chunk)
+		for range b.N {
+			if _, err := clientConn.Write(data); err != nil {
+				return
+			}
+		}
+		clientConn.(*net.TCPConn).CloseWrite()
+	}()
+
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(io.Discard, serverConn)
+		received <- n
+	}()
+
+	if err := fn(dstConn, srcConn); err != nil {
+		b.Fatal(err)
+	}
+	dstConn.(*net.TCPConn).CloseWrite()
+
+	if n := <-received; n != int64(b.N)*chunk {
+		b.Fatalf("received %d bytes, expected %d", n, int64(b.N)*chunk)
+	}
+}
+
+func BenchmarkForwardThroughChannel(b *testing.B) {
+	benchmarkForward(b, forwardThroughChannel)
+}
+
+func BenchmarkForward(b *testing.B) {
+	benchmarkForward(b, func(dst net.Conn, src net.Conn) error {
+		buffer := getBuffer()
+		defer putBuffer(buffer)
+
+		return forward(dst, src, *buffer)
+	})
+}
@@ -1,7 +1,6 @@
 package common
 
 import (
-	"log"
 	"os"
 	"os/signal"
 	"time"
@@ -17,7 +16,7 @@ func HandleSignal(server CloseableServer) {
 
 	<-signalCh
 
-	log.Println("received interrupt signal, shutting down...")
+	logger.Info("received interrupt signal, shutting down...")
 
 	select {
 	case <-func() <-chan struct{} {
@@ -28,10 +27,10 @@ func HandleSignal(server CloseableServer) {
 		}()
 		return ch
 	}():
-		log.Println("server has been shut down")
+		logger.Info("server has been shut down")
 		os.Exit(0)
 	case <-time.After(time.Second * 3):
-		log.Println("server shutdown timeout")
+		logger.Error("server shutdown timeout")
 		os.Exit(1)
 	}
 }
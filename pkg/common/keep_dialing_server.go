@@ -2,46 +2,85 @@ package common
 
 import (
 	"crypto/ed25519"
+	crand "crypto/rand"
 	"crypto/tls"
-	"crypto/x509"
+	"encoding/hex"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"math/rand"
+	"net"
+	"sync"
 	"time"
 
 	constant "github.com/samlior/tcp-reverse-proxy/pkg/constant"
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+	"github.com/samlior/tcp-reverse-proxy/pkg/metrics"
+	"github.com/samlior/tcp-reverse-proxy/pkg/mux"
+	"github.com/samlior/tcp-reverse-proxy/pkg/protocol"
 )
 
+var poolLogger = logging.New("pool")
+
 type KeepDialingServer struct {
 	*CommonServer
 
 	OnDial func(conn *Conn) error
 
-	groupId    uint8
+	// relative share of the connections we should receive from the relay server,
+	// zero means the default
+	Weight uint16
+	// maximum time allowed to establish the tls connection to a relay server
+	DialTimeout time.Duration
+	// upper bound of the exponential backoff after a relay server failed
+	MaxBackoff time.Duration
+
 	isUpstream bool
+	// sent to the relay server so that it can tell us apart from other clients sharing our key
+	instance string
+	// number of multiplexed sessions to the relay server,
+	// zero means every connection is a separate tls connection
+	multiplex int
+
+	sessionLock sync.Mutex
+	sessions    []*relaySession
+
+	// connections dialed to the relay servers which are not closed yet
+	relayConnsLock sync.Mutex
+	relayConns     map[*Conn]*relayConn
 
-	semaphore           chan struct{}
-	certPool            *x509.CertPool
-	serverAddress       string
+	pool      *dialPool
+	tlsConfig *tls.Config
+	relays    *relayPool
+	// nil when we are authenticated by a client certificate
 	authPrivateKeyBytes []byte
 }
 
 func NewKeepDialingServer(
-	groupId uint8,
+	group string,
 	isUpstream bool,
-	serverAddress string,
+	serverAddresses []string,
 	authPrivateKeyBytes []byte,
-	certPool *x509.CertPool) *KeepDialingServer {
+	tlsConfig *tls.Config,
+	multiplex int,
+	minPoolSize int,
+	maxPoolSize int) *KeepDialingServer {
 	s := &KeepDialingServer{
-		groupId:             groupId,
+		instance:            newInstance(),
 		isUpstream:          isUpstream,
-		semaphore:           make(chan struct{}, constant.Concurrency),
-		serverAddress:       serverAddress,
+		multiplex:           multiplex,
+		pool:                newDialPool(minPoolSize, maxPoolSize),
+		DialTimeout:         constant.DialTimeout,
+		MaxBackoff:          constant.RelayBackoffMax,
+		relays:              newRelayPool(serverAddresses),
+		relayConns:          make(map[*Conn]*relayConn),
 		authPrivateKeyBytes: authPrivateKeyBytes,
-		certPool:            certPool,
+		tlsConfig:           tlsConfig,
 		CommonServer:        NewCommonServer(),
 	}
 
+	s.Group = group
+
 	var keepDialingConnType string
 	if isUpstream {
 		keepDialingConnType = constant.ConnTypeUp
@@ -50,11 +89,15 @@ func NewKeepDialingServer(
 	}
 
 	s.OnConnClosed = func(conn *Conn) {
+		s.relayConnsLock.Lock()
+		delete(s.relayConns, conn)
+		s.relayConnsLock.Unlock()
+
 		// whenever a connection drops,
 		// immediately establish a new one to maintain
 		// a consistent number of pending connections
 		if conn.Type == keepDialingConnType && conn.Status == constant.ConnStatusPending {
-			go s.releaseSemaphore(1)
+			go s.releaseSlot(0)
 		}
 	}
 
@@ -62,15 +105,23 @@ func NewKeepDialingServer(
 		// whenever two connection connect to each other,
 		// immediately establish a new one to maintain
 		// a consistent number of pending connections
-		go s.releaseSemaphore(1)
+		s.pool.paired()
+		go s.releaseSlot(0)
 	}
 
 	return s
 }
 
-func (s *KeepDialingServer) releaseSemaphore(multiple int) {
-	time.Sleep(time.Millisecond * time.Duration((rand.Intn(50)+50)*multiple))
-	<-s.semaphore
+// newInstance returns a random instance id
+func newInstance() string {
+	instance := make([]byte, 8)
+	crand.Read(instance)
+	return hex.EncodeToString(instance)
+}
+
+func (s *KeepDialingServer) releaseSlot(delay time.Duration) {
+	time.Sleep(delay + time.Millisecond*time.Duration(rand.Intn(50)+50))
+	s.pool.release()
 }
 
 func (s *KeepDialingServer) onDial(conn *Conn) error {
@@ -80,13 +131,194 @@ func (s *KeepDialingServer) onDial(conn *Conn) error {
 	return nil
 }
 
+// handshake authenticates the connection, it returns whether its data is framed from now on
+func (s *KeepDialingServer) handshake(conn *tls.Conn, multiplex bool) (bool, error) {
+	conn.SetDeadline(time.Now().Add(constant.HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge, err := protocol.ExpectMessage(conn, protocol.MessageTypeChallenge)
+	if err != nil {
+		return false, err
+	}
+	if len(challenge.Payload) != protocol.ChallengeSize {
+		protocol.Reject(conn, "invalid challenge")
+		return false, errors.New("invalid challenge")
+	}
+
+	// inform the relay server our type and group id
+	auth := &protocol.Auth{
+		Group:     s.Group,
+		Multiplex: multiplex,
+		Instance:  s.instance,
+		Weight:    s.Weight,
+		Framing:   !multiplex,
+	}
+	if s.isUpstream {
+		auth.Role = protocol.RoleUp
+	} else {
+		auth.Role = protocol.RoleDown
+	}
+
+	// without a private key, the relay server authenticates us by our client certificate
+	payload := auth.Marshal()
+	if s.authPrivateKeyBytes != nil {
+		auth.PublicKey = ed25519.PrivateKey(s.authPrivateKeyBytes).Public().(ed25519.PublicKey)
+
+		payload, err = auth.Sign(s.authPrivateKeyBytes, conn.ConnectionState(), challenge.Payload)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = protocol.WriteMessage(conn, protocol.MessageTypeAuth, payload)
+	if err != nil {
+		return false, err
+	}
+
+	// wait for the relay server to accept us
+	msg, err := protocol.ExpectMessage(conn, protocol.MessageTypeAccept)
+	if err != nil {
+		return false, err
+	}
+	accept, err := protocol.UnmarshalAccept(msg.Payload)
+	if err != nil {
+		return false, err
+	}
+	return accept.Framing, nil
+}
+
+func (s *KeepDialingServer) dialEndpoint(endpoint *relayEndpoint, multiplex bool) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.DialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", endpoint.address, s.tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial to relay server %s: %w", endpoint.address, err)
+	}
+
+	framed, err := s.handshake(conn, multiplex)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to handshake with relay server %s: %w", endpoint.address, err)
+	}
+
+	// older relay servers forward the data as is
+	if framed {
+		return protocol.NewFramedConn(conn), nil
+	}
+	return conn, nil
+}
+
+// dialRelay dials the relay servers in order of preference until one of them succeeds
+func (s *KeepDialingServer) dialRelay(multiplex bool) (net.Conn, *relayEndpoint, error) {
+	for _, endpoint := range s.relays.candidates() {
+		if !s.relays.begin(endpoint) {
+			continue
+		}
+
+		conn, err := s.dialEndpoint(endpoint, multiplex)
+		if err == nil {
+			s.relays.succeeded(endpoint)
+			return conn, endpoint, nil
+		}
+
+		poolLogger.Warn("failed to connect to relay server", slog.String("relay", endpoint.address), logging.Err(err))
+		metrics.RelayDialErrors.WithLabelValues(endpoint.address).Inc()
+		s.relays.failed(endpoint, s.MaxBackoff)
+	}
+
+	return nil, nil, errors.New("no relay server available")
+}
+
+// pruneSessions drops closed sessions and closes drained sessions
+// to relay servers other than the preferred one,
+// the session lock must be held
+func (s *KeepDialingServer) pruneSessions(preferred *relayEndpoint) {
+	sessions := s.sessions[:0]
+	for _, session := range s.sessions {
+		if session.IsClosed() {
+			continue
+		}
+		if session.endpoint != preferred && session.NumStreams() == 0 {
+			poolLogger.Info("session closed", slog.String("relay", session.endpoint.address), slog.String(logging.KeyRemoteAddr, session.RemoteAddr().String()))
+			session.Close()
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	s.sessions = sessions
+}
+
+// openStream opens a stream on the least loaded session to the most preferred relay server,
+// a new session is established if there are fewer than expected
+func (s *KeepDialingServer) openStream() (net.Conn, *relayEndpoint, error) {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+
+	preferred, _ := s.relays.preferred()
+	s.pruneSessions(preferred)
+
+	count := 0
+	for _, session := range s.sessions {
+		if session.endpoint == preferred {
+			count++
+		}
+	}
+
+	if count < s.multiplex {
+		conn, endpoint, err := s.dialRelay(true)
+		if err != nil {
+			if len(s.sessions) == 0 {
+				return nil, nil, err
+			}
+			// fall back to the existing sessions
+			poolLogger.Warn("failed to open a session, falling back to the existing ones", logging.Err(err))
+		} else {
+			session := &relaySession{
+				Session:  mux.Client(conn),
+				endpoint: endpoint,
+			}
+			s.sessions = append(s.sessions, session)
+			poolLogger.Info("session opened", slog.String("relay", endpoint.address), slog.String(logging.KeyRemoteAddr, session.RemoteAddr().String()))
+		}
+	}
+
+	var selected *relaySession
+	for _, session := range s.sessions {
+		if selected == nil ||
+			session.endpoint.priority < selected.endpoint.priority ||
+			session.endpoint == selected.endpoint && session.NumStreams() < selected.NumStreams() {
+			selected = session
+		}
+	}
+
+	stream, err := selected.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return stream, selected.endpoint, nil
+}
+
+func (s *KeepDialingServer) closeSessions() {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+
+	for _, session := range s.sessions {
+		session.Close()
+	}
+	s.sessions = nil
+}
+
 func (s *KeepDialingServer) dial() {
-	conn, err := tls.Dial("tcp", s.serverAddress, &tls.Config{
-		RootCAs: s.certPool,
-	})
+	var conn net.Conn
+	var endpoint *relayEndpoint
+	var err error
+	if s.multiplex > 0 {
+		conn, endpoint, err = s.openStream()
+	} else {
+		conn, endpoint, err = s.dialRelay(false)
+	}
 	if err != nil {
-		log.Println("failed to dial to relay server:", err)
-		go s.releaseSemaphore(100)
+		poolLogger.Warn("failed to dial a connection to the pool", logging.Err(err))
+		go s.releaseSlot(s.relays.nextRetry())
 		return
 	}
 
@@ -97,44 +329,102 @@ func (s *KeepDialingServer) dial() {
 		keepDialingConnType = constant.ConnTypeDown
 	}
 
-	s.CommonServer.HandleConnection(conn, keepDialingConnType, func(conn *Conn) error {
-		challenge := <-conn.Ch
-		if len(challenge) != 32 {
-			return errors.New("invalid challenge")
-		}
+	relayConn := &relayConn{
+		Conn:     conn,
+		endpoint: endpoint,
+	}
 
-		signature := ed25519.Sign(s.authPrivateKeyBytes, challenge)
+	s.CommonServer.HandleConnection(relayConn, keepDialingConnType, func(conn *Conn) error {
+		s.relayConnsLock.Lock()
+		s.relayConns[conn] = relayConn
+		s.relayConnsLock.Unlock()
 
-		var flag byte
-		if s.isUpstream {
-			flag = 0x01
-		} else {
-			flag = 0x02
-		}
+		// invoke the callback
+		return s.onDial(conn)
+	})
+}
 
-		// inform the relay server our type and group id
-		_, err = conn.Conn.Write(append([]byte{flag, s.groupId}, signature...))
-		if err != nil {
-			return err
+// failback moves idle connections back to the preferred relay server,
+// while it is not known to be healthy a single connection is moved to probe it
+func (s *KeepDialingServer) failback() {
+	preferred, healthy := s.relays.preferred()
+	if preferred == nil {
+		return
+	}
+
+	var idle []*Conn
+	s.relayConnsLock.Lock()
+	for conn, relayConn := range s.relayConns {
+		if relayConn.endpoint.priority > preferred.priority && !relayConn.used.Load() {
+			idle = append(idle, conn)
 		}
+	}
+	s.relayConnsLock.Unlock()
 
-		// invoke the callback
-		err = s.onDial(conn)
-		if err != nil {
-			return err
+	if len(idle) == 0 {
+		return
+	}
+	if !healthy {
+		idle = idle[:1]
+	}
+
+	poolLogger.Info("moving idle connections back to relay server", slog.String("relay", preferred.address), slog.Int("connections", len(idle)))
+
+	// every closed connection is dialed again
+	for _, conn := range idle {
+		s.closePending(conn)
+	}
+
+	s.sessionLock.Lock()
+	s.pruneSessions(preferred)
+	s.sessionLock.Unlock()
+}
+
+// trimPool closes idle connections which exceed the pool size,
+// their slots are released as they are closed
+func (s *KeepDialingServer) trimPool(excess int) {
+	var idle []*Conn
+	s.relayConnsLock.Lock()
+	for conn, relayConn := range s.relayConns {
+		if len(idle) == excess {
+			break
+		}
+		if !relayConn.used.Load() {
+			idle = append(idle, conn)
 		}
+	}
+	s.relayConnsLock.Unlock()
 
-		return nil
-	})
+	for _, conn := range idle {
+		s.closePending(conn)
+	}
 }
 
 func (s *KeepDialingServer) KeepDialing() {
+	failbackTicker := time.NewTicker(constant.RelayFailbackInterval)
+	defer failbackTicker.Stop()
+
+	adjustTicker := time.NewTicker(constant.PoolAdjustInterval)
+	defer adjustTicker.Stop()
+
 	for {
+		for n := s.pool.acquire(); n > 0; n-- {
+			go s.dial()
+		}
+
 		select {
 		case <-s.Closed:
+			s.closeSessions()
 			return
-		case s.semaphore <- struct{}{}:
-			go s.dial()
+		case <-failbackTicker.C:
+			if len(s.relays.endpoints) > 1 {
+				s.failback()
+			}
+		case <-adjustTicker.C:
+			if excess := s.pool.adjust(); excess > 0 {
+				s.trimPool(excess)
+			}
+		case <-s.pool.wake:
 		}
 	}
 }
@@ -0,0 +1,193 @@
+package common
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	constant "github.com/samlior/tcp-reverse-proxy/pkg/constant"
+	"github.com/samlior/tcp-reverse-proxy/pkg/metrics"
+)
+
+func newDesc(name string, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "", name), help, labels, nil)
+}
+
+var (
+	connectionsDesc        = newDesc("connections", "Connections by type and status, pending until they are connected to their partner.", "type", "status", "group")
+	pendingConnectionsDesc = newDesc("pending_connections", "Connections in the pending queues, including the idle connections of the pools.", "type", "group")
+	waitingConnectionsDesc = newDesc("waiting_connections", "Connections carrying a session which wait for their partner.", "group")
+	rejectedDesc           = newDesc("rejected_connections_total", "Connections rejected because the queue was full.")
+	timedOutDesc           = newDesc("timed_out_connections_total", "Connections closed after waiting too long for their partner.")
+	bandwidthBytesDesc     = newDesc("bandwidth_bytes_total", "Bytes forwarded under a bandwidth limit, group limits start over once the group is idle.", "limit", "direction")
+	bandwidthLimitDesc     = newDesc("bandwidth_limit_bytes_per_second", "Bandwidth limits, zero means unlimited.", "limit", "direction")
+
+	poolSizeDesc        = newDesc("pool_size", "Expected number of dialing and pending connections to the relay server.")
+	poolConnectionsDesc = newDesc("pool_connections", "Current number of dialing and pending connections to the relay server.")
+	circuitStateDesc    = newDesc("relay_circuit_state", "State of the circuit breaker of a relay server: 0 closed, 1 open, 2 half-open.", "relay")
+	relayFailuresDesc   = newDesc("relay_failures", "Consecutive failures of a relay server.", "relay")
+)
+
+func statusName(status int) string {
+	switch status {
+	case constant.ConnStatusPending:
+		return "pending"
+	case constant.ConnStatusConnected:
+		return "connected"
+	default:
+		return "closed"
+	}
+}
+
+// countingReader counts the bytes read for the metrics and the connection
+type countingReader struct {
+	reader  io.Reader
+	counter prometheus.Counter
+	total   *atomic.Uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.counter.Add(float64(n))
+		r.total.Add(uint64(n))
+	}
+	return n, err
+}
+
+// transferredBytes returns the counter of the data read from conn once connected to another
+func (cs *CommonServer) transferredBytes(conn *Conn, another *Conn) prometheus.Counter {
+	direction := "download"
+	if conn.Type == cs.ClientConnType {
+		direction = "upload"
+	}
+
+	route := conn.RouteName
+	if route == "" {
+		route = another.RouteName
+	}
+
+	return metrics.TransferredBytes.WithLabelValues(conn.Group, route, direction)
+}
+
+// observePairingLocked records how long a connection carrying a session waited for its partner,
+// the idle connections of a pool are not recorded, the server lock must be held
+func (cs *CommonServer) observePairingLocked(conn *Conn) {
+	var since time.Time
+	if conn.waiting {
+		since = conn.waitingSince
+	} else if conn.Client {
+		since = conn.CreatedAt
+	} else {
+		return
+	}
+
+	metrics.PairingLatency.WithLabelValues(conn.Group).Observe(time.Since(since).Seconds())
+}
+
+type connKey struct {
+	connType string
+	status   int
+	group    string
+}
+
+type serverCollector struct {
+	cs *CommonServer
+}
+
+// Collector collects the connections, the queues and the bandwidths of the server
+func (cs *CommonServer) Collector() prometheus.Collector {
+	return &serverCollector{cs}
+}
+
+func (c *serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectionsDesc
+	ch <- pendingConnectionsDesc
+	ch <- waitingConnectionsDesc
+	ch <- rejectedDesc
+	ch <- timedOutDesc
+	ch <- bandwidthBytesDesc
+	ch <- bandwidthLimitDesc
+}
+
+func (c *serverCollector) Collect(ch chan<- prometheus.Metric) {
+	cs := c.cs
+
+	connections := make(map[connKey]int)
+	pending := make(map[connKey]int)
+	waiting := make(map[string]int)
+
+	cs.lock.Lock()
+	for _, conn := range cs.connections {
+		connections[connKey{conn.Type, conn.Status, conn.Group}]++
+		if conn.pending != nil {
+			pending[connKey{conn.Type, conn.Status, conn.Group}]++
+		}
+	}
+	for group, n := range cs.waitingPerGroup {
+		waiting[group] = n
+	}
+	cs.lock.Unlock()
+
+	for key, n := range connections {
+		ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(n), key.connType, statusName(key.status), key.group)
+	}
+	for key, n := range pending {
+		ch <- prometheus.MustNewConstMetric(pendingConnectionsDesc, prometheus.GaugeValue, float64(n), key.connType, key.group)
+	}
+	for group, n := range waiting {
+		ch <- prometheus.MustNewConstMetric(waitingConnectionsDesc, prometheus.GaugeValue, float64(n), group)
+	}
+
+	ch <- prometheus.MustNewConstMetric(rejectedDesc, prometheus.CounterValue, float64(cs.Rejected.Load()))
+	ch <- prometheus.MustNewConstMetric(timedOutDesc, prometheus.CounterValue, float64(cs.TimedOut.Load()))
+
+	for _, limit := range cs.BandwidthLimits() {
+		for direction, bandwidth := range map[string]*Bandwidth{"upload": limit.Upload, "download": limit.Download} {
+			ch <- prometheus.MustNewConstMetric(bandwidthBytesDesc, prometheus.CounterValue, float64(bandwidth.Total()), limit.Name, direction)
+			ch <- prometheus.MustNewConstMetric(bandwidthLimitDesc, prometheus.GaugeValue, float64(bandwidth.Limit()), limit.Name, direction)
+		}
+	}
+}
+
+type keepDialingCollector struct {
+	serverCollector
+
+	s *KeepDialingServer
+}
+
+// Collector collects the pool and the circuit breakers of the relay servers along with the state of the server
+func (s *KeepDialingServer) Collector() prometheus.Collector {
+	return &keepDialingCollector{serverCollector{s.CommonServer}, s}
+}
+
+func (c *keepDialingCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.serverCollector.Describe(ch)
+	ch <- poolSizeDesc
+	ch <- poolConnectionsDesc
+	ch <- circuitStateDesc
+	ch <- relayFailuresDesc
+}
+
+func (c *keepDialingCollector) Collect(ch chan<- prometheus.Metric) {
+	c.serverCollector.Collect(ch)
+
+	pool := c.s.pool
+	pool.lock.Lock()
+	size, slots := pool.size, pool.slots
+	pool.lock.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(poolSizeDesc, prometheus.GaugeValue, float64(size))
+	ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(slots))
+
+	relays := c.s.relays
+	now := time.Now()
+	relays.lock.Lock()
+	defer relays.lock.Unlock()
+
+	for _, endpoint := range relays.endpoints {
+		ch <- prometheus.MustNewConstMetric(circuitStateDesc, prometheus.GaugeValue, float64(endpoint.state(now)), endpoint.address)
+		ch <- prometheus.MustNewConstMetric(relayFailuresDesc, prometheus.GaugeValue, float64(endpoint.failures), endpoint.address)
+	}
+}
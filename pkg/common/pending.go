@@ -0,0 +1,164 @@
+package common
+
+import "container/list"
+
+type PendingConnection struct {
+	conn      *Conn
+	anotherCh chan *Conn
+
+	// the order it became pending in
+	seq uint64
+
+	// position in the pending queues, for the removal in constant time
+	bucket      *pendingBucket
+	element     *list.Element
+	peerElement *list.Element
+}
+
+// only connections with the same group and match id can be connected to each other
+type pendingKey struct {
+	group   string
+	matchId string
+}
+
+func keyOfPending(conn *Conn) pendingKey {
+	return pendingKey{conn.Group, string(conn.MatchId)}
+}
+
+// pendingBucket holds the pending connections of one side with the same key,
+// in the order they became pending
+type pendingBucket struct {
+	key pendingKey
+
+	all *list.List
+	// the pending connections of every peer, so that balancers only look at the oldest of each
+	peers map[string]*pendingPeer
+	// the peers ordered by the age of their oldest pending connection, oldest first
+	fronts *list.List
+}
+
+// pendingPeer holds the pending connections of a peer in a bucket
+type pendingPeer struct {
+	conns *list.List
+	// position in the fronts of the bucket
+	front *list.Element
+}
+
+func (p *pendingPeer) oldest() *PendingConnection {
+	return p.conns.Front().Value.(*PendingConnection)
+}
+
+// pendingQueue indexes the pending connections of one side by their key
+type pendingQueue struct {
+	buckets map[pendingKey]*pendingBucket
+	length  int
+	seq     uint64
+
+	// reused by every match, so that balanced pairing does not allocate
+	candidates []*Conn
+}
+
+func newPendingQueue() *pendingQueue {
+	return &pendingQueue{
+		buckets: make(map[pendingKey]*pendingBucket),
+	}
+}
+
+func (q *pendingQueue) Len() int {
+	return q.length
+}
+
+func (q *pendingQueue) push(p *PendingConnection) {
+	key := keyOfPending(p.conn)
+	bucket, ok := q.buckets[key]
+	if !ok {
+		bucket = &pendingBucket{
+			key:    key,
+			all:    list.New(),
+			peers:  make(map[string]*pendingPeer),
+			fronts: list.New(),
+		}
+		q.buckets[key] = bucket
+	}
+
+	peer, ok := bucket.peers[p.conn.Peer]
+	if !ok {
+		peer = &pendingPeer{
+			conns: list.New(),
+		}
+		bucket.peers[p.conn.Peer] = peer
+	}
+
+	q.seq++
+	p.seq = q.seq
+	p.bucket = bucket
+	p.element = bucket.all.PushBack(p)
+	p.peerElement = peer.conns.PushBack(p)
+	if !ok {
+		// the new connection is younger than the oldest connection of every other peer
+		peer.front = bucket.fronts.PushBack(peer)
+	}
+	q.length++
+}
+
+func (q *pendingQueue) remove(p *PendingConnection) {
+	bucket := p.bucket
+	if bucket == nil {
+		return
+	}
+
+	bucket.all.Remove(p.element)
+	peer := bucket.peers[p.conn.Peer]
+	wasOldest := peer.conns.Front() == p.peerElement
+	peer.conns.Remove(p.peerElement)
+	if peer.conns.Len() == 0 {
+		bucket.fronts.Remove(peer.front)
+		delete(bucket.peers, p.conn.Peer)
+	} else if wasOldest {
+		// the next connection of the peer is younger, move the peer back to keep the fronts ordered,
+		// it usually became pending after the oldest connection of every other peer, so search from the back
+		seq := peer.oldest().seq
+		mark := bucket.fronts.Back()
+		for mark != peer.front && mark.Value.(*pendingPeer).oldest().seq > seq {
+			mark = mark.Prev()
+		}
+		if mark != peer.front {
+			bucket.fronts.MoveAfter(peer.front, mark)
+		}
+	}
+	if bucket.all.Len() == 0 {
+		delete(q.buckets, bucket.key)
+	}
+
+	p.bucket = nil
+	p.element = nil
+	p.peerElement = nil
+	q.length--
+}
+
+// match returns the pending connection conn should be connected to, nil if there is none,
+// the oldest one is chosen unless a balancer is given.
+// Without a balancer it takes constant time, otherwise it is linear in the number of peers of the bucket
+func (q *pendingQueue) match(conn *Conn, balancer Balancer) *PendingConnection {
+	bucket, ok := q.buckets[keyOfPending(conn)]
+	if !ok {
+		return nil
+	}
+
+	if balancer == nil || len(bucket.peers) == 1 {
+		return bucket.all.Front().Value.(*PendingConnection)
+	}
+
+	candidates := q.candidates[:0]
+	for front := bucket.fronts.Front(); front != nil; front = front.Next() {
+		candidates = append(candidates, front.Value.(*pendingPeer).oldest().conn)
+	}
+
+	selected := balancer.Select(conn, candidates).pending
+
+	// do not keep the connections alive
+	clear(candidates)
+	q.candidates = candidates
+
+	return selected
+}
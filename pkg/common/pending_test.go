@@ -0,0 +1,152 @@
+package common
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	constant "github.com/samlior/tcp-reverse-proxy/pkg/constant"
+)
+
+func newPending(id uint64, group string, peer string) *PendingConnection {
+	p := &PendingConnection{
+		conn: &Conn{
+			Id:    id,
+			Type:  constant.ConnTypeUp,
+			Group: group,
+			Peer:  peer,
+		},
+	}
+	p.conn.pending = p
+	return p
+}
+
+// recordingBalancer selects the first candidate and keeps the candidates it has been given
+type recordingBalancer struct {
+	candidates []*Conn
+}
+
+func (b *recordingBalancer) Select(conn *Conn, candidates []*Conn) *Conn {
+	b.candidates = append(b.candidates[:0], candidates...)
+	return candidates[0]
+}
+
+func (b *recordingBalancer) Added(conn *Conn) {}
+
+func (b *recordingBalancer) Connected(conn *Conn, another *Conn) {}
+
+func (b *recordingBalancer) Disconnected(conn *Conn) {}
+
+func (b *recordingBalancer) Removed(conn *Conn) {}
+
+func TestPendingQueueCandidatesAreOldestFirst(t *testing.T) {
+	q := newPendingQueue()
+	balancer := &recordingBalancer{}
+	rng := rand.New(rand.NewPCG(1, 2))
+	conn := &Conn{Type: constant.ConnTypeDown, Group: "g"}
+
+	var pending []*PendingConnection
+	for id := uint64(1); id <= 2000; id++ {
+		if len(pending) > 0 && rng.IntN(2) == 0 {
+			// remove a random connection, which is often the oldest of its peer
+			i := rng.IntN(len(pending))
+			q.remove(pending[i])
+			pending = append(pending[:i], pending[i+1:]...)
+		} else {
+			p := newPending(id, "g", fmt.Sprint(rng.IntN(8)))
+			q.push(p)
+			pending = append(pending, p)
+		}
+
+		if q.Len() != len(pending) {
+			t.Fatalf("length %d, expected %d", q.Len(), len(pending))
+		}
+		if len(pending) == 0 || q.match(conn, balancer) == nil {
+			continue
+		}
+
+		// the candidates are the oldest connection of every peer, oldest first
+		oldest := make(map[string]*PendingConnection)
+		for _, p := range pending {
+			if _, ok := oldest[p.conn.Peer]; !ok {
+				oldest[p.conn.Peer] = p
+			}
+		}
+		if len(oldest) == 1 {
+			continue
+		}
+		if len(balancer.candidates) != len(oldest) {
+			t.Fatalf("%d candidates, expected %d", len(balancer.candidates), len(oldest))
+		}
+		for i, candidate := range balancer.candidates {
+			if oldest[candidate.Peer].conn != candidate {
+				t.Fatalf("candidate %d is not the oldest of peer %s", candidate.Id, candidate.Peer)
+			}
+			if i > 0 && balancer.candidates[i-1].pending.seq > candidate.pending.seq {
+				t.Fatalf("candidate %d is older than candidate %d", candidate.Id, balancer.candidates[i-1].Id)
+			}
+		}
+	}
+}
+
+// BenchmarkPendingQueuePushRemove pushes and removes a connection in a queue holding size connections of groups groups
+func BenchmarkPendingQueuePushRemove(b *testing.B) {
+	for _, groups := range []int{1, 100, 10000} {
+		for _, size := range []int{100, 10000} {
+			b.Run(fmt.Sprintf("groups=%d/size=%d", groups, size), func(b *testing.B) {
+				q := newPendingQueue()
+				for i := range size {
+					q.push(newPending(uint64(i), fmt.Sprint(i%groups), fmt.Sprint(i%4)))
+				}
+
+				pending := make([]*PendingConnection, 1024)
+				for i := range pending {
+					pending[i] = newPending(uint64(size+i), fmt.Sprint(i%groups), fmt.Sprint(i%4))
+				}
+
+				b.ResetTimer()
+				for i := range b.N {
+					p := pending[i%len(pending)]
+					q.push(p)
+					q.remove(p)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkPendingQueueMatch pairs a connection in a group holding size connections of peers peers,
+// the matched connection is removed and a new one of the same peer is pushed, like a pool replacing it
+func BenchmarkPendingQueueMatch(b *testing.B) {
+	balancers := []string{BalancerFirst, BalancerRoundRobin, BalancerLeastActive, BalancerWeighted}
+	for _, name := range balancers {
+		for _, peers := range []int{1, 10, 100} {
+			for _, size := range []int{100, 10000} {
+				b.Run(fmt.Sprintf("%s/peers=%d/size=%d", name, peers, size), func(b *testing.B) {
+					balancer, err := NewBalancer(name)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					q := newPendingQueue()
+					id := uint64(0)
+					for i := range size {
+						id++
+						q.push(newPending(id, "g", fmt.Sprint(i%peers)))
+					}
+					conn := &Conn{Type: constant.ConnTypeDown, Group: "g"}
+
+					b.ReportAllocs()
+					b.ResetTimer()
+					for range b.N {
+						p := q.match(conn, balancer)
+						q.remove(p)
+						id++
+						p.conn.Id = id
+						q.push(p)
+					}
+				})
+			}
+		}
+	}
+}
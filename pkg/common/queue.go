@@ -0,0 +1,113 @@
+package common
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"time"
+
+	constant "github.com/samlior/tcp-reverse-proxy/pkg/constant"
+)
+
+// startWaitingLocked starts the wait of a pending connection for its partner,
+// it returns false if the connection has been rejected because the queue is full,
+// the server lock must be held.
+// A connection waits once it is known to carry a session, that is as soon as it is registered
+// for a client of the entry-point and once it received data otherwise,
+// so that the idle connections of a pool never time out
+func (cs *CommonServer) startWaitingLocked(conn *Conn) bool {
+	if conn.waiting || conn.Status != constant.ConnStatusPending {
+		return true
+	}
+
+	if cs.MaxQueue > 0 && cs.waiting >= cs.MaxQueue ||
+		cs.MaxQueuePerGroup > 0 && cs.waitingPerGroup[conn.Group] >= cs.MaxQueuePerGroup {
+		rejected := cs.Rejected.Add(1)
+		logger.Warn("connection rejected, queue is full", conn.LogAttrs(slog.Uint64("rejected_total", rejected))...)
+		cs.abortLocked(conn)
+		return false
+	}
+
+	conn.waiting = true
+	conn.waitingSince = time.Now()
+	cs.waiting++
+	cs.waitingPerGroup[conn.Group]++
+
+	if cs.MaxWait > 0 {
+		conn.waitTimer = time.AfterFunc(cs.MaxWait, func() {
+			cs.waitTimedOut(conn)
+		})
+	}
+
+	return true
+}
+
+// stopWaitingLocked is called when a waiting connection has been connected or closed,
+// the server lock must be held
+func (cs *CommonServer) stopWaitingLocked(conn *Conn) {
+	if !conn.waiting {
+		return
+	}
+
+	conn.waiting = false
+	cs.waiting--
+	cs.waitingPerGroup[conn.Group]--
+	if cs.waitingPerGroup[conn.Group] <= 0 {
+		delete(cs.waitingPerGroup, conn.Group)
+	}
+
+	if conn.waitTimer != nil {
+		conn.waitTimer.Stop()
+		conn.waitTimer = nil
+	}
+}
+
+func (cs *CommonServer) startWaiting(conn *Conn) {
+	cs.lock.Lock()
+	defer cs.unlock()
+
+	cs.startWaitingLocked(conn)
+}
+
+func (cs *CommonServer) waitTimedOut(conn *Conn) {
+	cs.lock.Lock()
+	defer cs.unlock()
+
+	// it has been connected or closed in the meantime
+	if !conn.waiting {
+		return
+	}
+
+	timedOut := cs.TimedOut.Add(1)
+	logger.Warn("connection timed out waiting for a partner", conn.LogAttrs(slog.Uint64("timed_out_total", timedOut))...)
+	cs.abortLocked(conn)
+}
+
+// abortLocked closes a connection which could not be connected,
+// the server lock must be held
+func (cs *CommonServer) abortLocked(conn *Conn) {
+	if cs.ResetOnReject {
+		conn.resetOnClose = true
+	}
+	cs.removeConnLocked(conn)
+}
+
+// setReset makes the connection reset instead of closed gracefully
+func setReset(conn net.Conn) {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		c.SetLinger(0)
+	case *tls.Conn:
+		// close the underlying connection right away,
+		// otherwise closing the tls connection sends a close_notify alert which reads as a half-close
+		setReset(c.NetConn())
+		c.NetConn().Close()
+	case *relayConn:
+		setReset(c.Conn)
+	case interface{ Reset() error }:
+		c.Reset()
+	case interface{ NetConn() net.Conn }:
+		// a wrapper like the connections received through a proxy
+		setReset(c.NetConn())
+	}
+}
@@ -0,0 +1,197 @@
+package common
+
+import (
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	constant "github.com/samlior/tcp-reverse-proxy/pkg/constant"
+	"github.com/samlior/tcp-reverse-proxy/pkg/mux"
+)
+
+// state of the circuit breaker of a relay server
+const (
+	// the relay server is healthy
+	circuitClosed = iota
+	// the relay server failed and is not dialed until its backoff expires
+	circuitOpen
+	// the backoff expired, a single dial is allowed to probe the relay server
+	circuitHalfOpen
+)
+
+// relayEndpoint is the address of a relay server and its health
+type relayEndpoint struct {
+	address string
+	// lower is preferred
+	priority int
+
+	// consecutive failures, zero means the endpoint is healthy
+	failures int
+	// the circuit is open until then after a failure
+	retryAt time.Time
+	// a probing dial is in progress while the circuit is half-open
+	probing bool
+}
+
+// state returns the state of the circuit breaker,
+// the pool lock must be held
+func (e *relayEndpoint) state(now time.Time) int {
+	if e.failures == 0 {
+		return circuitClosed
+	}
+	if now.Before(e.retryAt) {
+		return circuitOpen
+	}
+	return circuitHalfOpen
+}
+
+// relayPool tracks the health of the relay servers,
+// the first address is the primary and the others are used in order when it is down
+type relayPool struct {
+	lock      sync.Mutex
+	endpoints []*relayEndpoint
+}
+
+func newRelayPool(addresses []string) *relayPool {
+	endpoints := make([]*relayEndpoint, len(addresses))
+	for i, address := range addresses {
+		endpoints[i] = &relayEndpoint{
+			address:  address,
+			priority: i,
+		}
+	}
+	return &relayPool{endpoints: endpoints}
+}
+
+// candidates returns the endpoints whose circuit is not open, in order of preference
+func (p *relayPool) candidates() []*relayEndpoint {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	var candidates []*relayEndpoint
+	for _, endpoint := range p.endpoints {
+		if endpoint.state(now) != circuitOpen {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	return candidates
+}
+
+// preferred returns the endpoint new connections should go to and whether it is known to be healthy,
+// nil if the circuits of all of them are open
+func (p *relayPool) preferred() (*relayEndpoint, bool) {
+	candidates := p.candidates()
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return candidates[0], candidates[0].failures == 0
+}
+
+// begin is called before dialing the endpoint,
+// it returns false if the endpoint should not be dialed,
+// only one dial is allowed while the circuit is half-open
+func (p *relayPool) begin(endpoint *relayEndpoint) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch endpoint.state(time.Now()) {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		if endpoint.probing {
+			return false
+		}
+		endpoint.probing = true
+		poolLogger.Info("circuit breaker half-open, probing relay server", slog.String("relay", endpoint.address))
+	}
+	return true
+}
+
+// succeeded closes the circuit immediately
+func (p *relayPool) succeeded(endpoint *relayEndpoint) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if endpoint.failures > 0 {
+		poolLogger.Info("circuit breaker closed, relay server is available again", slog.String("relay", endpoint.address))
+	}
+	endpoint.failures = 0
+	endpoint.retryAt = time.Time{}
+	endpoint.probing = false
+}
+
+// failed opens the circuit for an exponential backoff with jitter
+func (p *relayPool) failed(endpoint *relayEndpoint, maxBackoff time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	// concurrent dials which were started before the circuit opened
+	// do not extend the backoff
+	if endpoint.state(now) == circuitOpen {
+		return
+	}
+
+	endpoint.failures++
+	endpoint.probing = false
+
+	backoff := maxBackoff
+	if endpoint.failures <= 32 {
+		backoff = min(constant.RelayBackoffBase<<(endpoint.failures-1), maxBackoff)
+	}
+	// equal jitter, so that clients do not come back at the same time
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	endpoint.retryAt = now.Add(backoff)
+
+	poolLogger.Warn("circuit breaker open", slog.String("relay", endpoint.address), slog.Int("failures", endpoint.failures), slog.Duration("retry_in", backoff.Round(time.Millisecond)))
+}
+
+// nextRetry returns how long to wait before dialing again after every relay server failed
+func (p *relayPool) nextRetry() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	var delay time.Duration
+	for i, endpoint := range p.endpoints {
+		wait := endpoint.retryAt.Sub(now)
+		if i == 0 || wait < delay {
+			delay = wait
+		}
+	}
+
+	// a probing dial may still be in progress
+	return max(delay, constant.RelayBackoffBase)
+}
+
+// relayConn is a connection to a relay server,
+// it remembers whether anything has been received so that idle connections can be recycled
+type relayConn struct {
+	net.Conn
+
+	endpoint *relayEndpoint
+	used     atomic.Bool
+}
+
+func (c *relayConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.used.Store(true)
+	}
+	return n, err
+}
+
+// relaySession is a multiplexed session to a relay server
+type relaySession struct {
+	*mux.Session
+
+	endpoint *relayEndpoint
+}
@@ -1,5 +1,7 @@
 package constant
 
+import "time"
+
 const (
 	ConnTypeUp      = "up"
 	ConnTypeDown    = "down"
@@ -12,4 +14,42 @@ const (
 	ConnStatusClosed
 )
 
-const Concurrency = 5
+// default bounds of the number of pending connections kept by the entry-point and the reverse-proxy
+const (
+	DefaultMinPoolSize = 2
+	DefaultMaxPoolSize = 32
+)
+
+// interval to resize the pool of pending connections after the rate they are consumed
+const PoolAdjustInterval = time.Second * 5
+
+// maximum time allowed for the handshake between a client and the relay server
+const HandshakeTimeout = time.Second * 5
+
+// maximum time allowed for a proxy in front of the entry-point to send the PROXY protocol header
+const ProxyHeaderTimeout = time.Second * 5
+
+// udp flows are closed after being idle for this long
+const UDPIdleTimeout = time.Second * 60
+
+// maximum time allowed to establish the tls connection to the relay server
+const DialTimeout = time.Second * 5
+
+// a relay server is not dialed again for an exponential backoff after a failure,
+// starting at RelayBackoffBase and doubling up to RelayBackoffMax
+const (
+	RelayBackoffBase = time.Second
+	RelayBackoffMax  = time.Minute
+)
+
+// interval to move idle connections back to a preferred relay server once it recovers
+const RelayFailbackInterval = time.Second * 10
+
+// default maximum time a connection which carries a session waits for its partner
+const MaxWait = time.Second * 30
+
+// size of the buffers used to forward data between connected connections
+const BufferSize = 32 * 1024
+
+// interval to log the rate of the bandwidth limits
+const BandwidthLogInterval = time.Second * 10
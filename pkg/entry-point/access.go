@@ -0,0 +1,173 @@
+package entry_point
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// parseClientPrefix parses a cidr, a single ip is the same as a cidr matching only itself
+func parseClientPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid cidr: %s", s)
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), max(prefix.Bits()-96, 0))
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid ip: %s", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// routeSelector selects the routes a client rule applies to by their listening address
+type routeSelector struct {
+	// empty for routes of both networks
+	network string
+	// empty for every listening host
+	host string
+	port uint16
+}
+
+// parseRouteSelector parses a selector in the following format:
+//
+//	[tcp/|udp/][ip:]port
+func parseRouteSelector(s string) (routeSelector, error) {
+	var selector routeSelector
+
+	if strings.HasPrefix(s, "tcp/") {
+		selector.network = "tcp"
+		s = strings.TrimPrefix(s, "tcp/")
+	} else if strings.HasPrefix(s, "udp/") {
+		selector.network = "udp"
+		s = strings.TrimPrefix(s, "udp/")
+	}
+
+	parts, err := splitRoute(s)
+	if err != nil {
+		return selector, err
+	}
+
+	port := parts[0]
+	if len(parts) == 2 {
+		selector.host, err = parseHost(parts[0])
+		if err != nil {
+			return selector, err
+		}
+		port = parts[1]
+	} else if len(parts) > 2 {
+		return selector, fmt.Errorf("invalid route: %s", s)
+	}
+
+	uint64Port, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return selector, fmt.Errorf("invalid source port: %s", port)
+	}
+	selector.port = uint16(uint64Port)
+
+	return selector, nil
+}
+
+func (s *routeSelector) matches(route *Route) bool {
+	return (s.network == "" || s.network == route.Network) &&
+		(s.host == "" || sameHost(s.host, route.SrcHost)) &&
+		s.port == route.SrcPort
+}
+
+// ApplyClientRules adds the client rules to the access lists of the routes,
+// a rule has the following format:
+//
+//	[[tcp/|udp/][ip:]port=]cidr
+//
+// a rule without a route applies to every route, a single ip is the same as a cidr matching only itself
+func ApplyClientRules(routes []Route, allow []string, deny []string) error {
+	apply := func(rule string, add func(route *Route, prefix netip.Prefix)) error {
+		var selector *routeSelector
+		cidr := rule
+		if s, c, ok := strings.Cut(rule, "="); ok {
+			parsed, err := parseRouteSelector(s)
+			if err != nil {
+				return fmt.Errorf("invalid client rule %s: %w", rule, err)
+			}
+			selector = &parsed
+			cidr = c
+		}
+
+		prefix, err := parseClientPrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid client rule %s: %w", rule, err)
+		}
+
+		matched := false
+		for i := range routes {
+			if selector == nil || selector.matches(&routes[i]) {
+				add(&routes[i], prefix)
+				matched = true
+			}
+		}
+		if !matched {
+			return fmt.Errorf("no route found for client rule: %s", rule)
+		}
+		return nil
+	}
+
+	for _, rule := range allow {
+		err := apply(rule, func(route *Route, prefix netip.Prefix) {
+			route.AllowClients = append(route.AllowClients, prefix)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range deny {
+		err := apply(rule, func(route *Route, prefix netip.Prefix) {
+			route.DenyClients = append(route.DenyClients, prefix)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addrPortOf returns the ip address and the port of a connection endpoint,
+// ipv4-mapped addresses are unmapped and zones are removed
+func addrPortOf(addr net.Addr) (netip.AddrPort, error) {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addrPort.Addr().Unmap().WithZone(""), addrPort.Port()), nil
+}
+
+// AcceptsClient returns whether the client may use the route,
+// a denied client is always rejected, and a client must be allowed if the route has an allow list
+func (r *Route) AcceptsClient(addr netip.Addr) bool {
+	for _, prefix := range r.DenyClients {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	if len(r.AllowClients) == 0 {
+		return true
+	}
+
+	for _, prefix := range r.AllowClients {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
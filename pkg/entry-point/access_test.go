@@ -0,0 +1,91 @@
+package entry_point
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestAcceptsClient(t *testing.T) {
+	routes, err := ParseRoutes([]string{"80:81", "udp/80:81", "127.0.0.1:90:91", "[::1]:90:91"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ApplyClientRules(routes,
+		[]string{"tcp/80=10.0.0.0/8", "tcp/80=fd00::/8", "127.0.0.1:90=::ffff:192.168.0.0/112"},
+		[]string{"10.0.0.1", "80=10.9.0.0/16", "[::1]:90=::/0"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		route    int
+		client   string
+		accepted bool
+	}{
+		{0, "10.1.2.3", true},
+		{0, "11.0.0.1", false},
+		{0, "fd00::1", true},
+		// deny is checked before allow
+		{0, "10.0.0.1", false},
+		{0, "10.9.1.1", false},
+		// ipv4-mapped ipv6 clients are checked as ipv4
+		{0, "::ffff:10.1.2.3", true},
+		{0, "::ffff:10.0.0.1", false},
+		{0, "::ffff:11.0.0.1", false},
+		// an empty allow list accepts everyone which is not denied
+		{1, "11.0.0.1", true},
+		{1, "::1", true},
+		{1, "10.0.0.1", false},
+		{1, "10.9.1.1", false},
+		{2, "192.168.1.1", true},
+		{2, "::ffff:192.168.1.1", true},
+		{2, "192.169.1.1", false},
+		{2, "10.0.0.1", false},
+		// the ipv6 deny does not reject ipv4 clients
+		{3, "11.0.0.1", true},
+		{3, "::1", false},
+		{3, "10.0.0.1", false},
+	} {
+		addr, err := addrPortOf(&net.TCPAddr{IP: net.ParseIP(test.client), Port: 1234})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accepted := routes[test.route].AcceptsClient(addr.Addr()); accepted != test.accepted {
+			t.Fatalf("route %s, client %s: expected %v, got %v", routes[test.route].String(), test.client, test.accepted, accepted)
+		}
+	}
+}
+
+func TestApplyClientRulesMalformed(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"10.0.0.0/33",
+		"example.com",
+		"x=10.0.0.1",
+		"sctp/80=10.0.0.1",
+		"[::1=10.0.0.1",
+		"1.2.3.4:5:80=10.0.0.1",
+		// no route listens on it
+		"81=10.0.0.1",
+		"udp/80=10.0.0.1",
+		"127.0.0.2:80=10.0.0.1",
+	} {
+		routes, err := ParseRoutes([]string{"tcp/127.0.0.1:80:81"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ApplyClientRules(routes, []string{rule}, nil); err == nil {
+			t.Fatalf("%q: expected an error", rule)
+		}
+		if err := ApplyClientRules(routes, nil, []string{rule}); err == nil {
+			t.Fatalf("%q: expected an error", rule)
+		}
+	}
+
+	if prefix, err := parseClientPrefix("::ffff:10.0.0.0/104"); err != nil || prefix != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Fatalf("expected 10.0.0.0/8, got %v %v", prefix, err)
+	}
+}
@@ -0,0 +1,89 @@
+package entry_point
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/samlior/tcp-reverse-proxy/pkg/constant"
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+	"github.com/samlior/tcp-reverse-proxy/pkg/proxyproto"
+)
+
+// ApplyProxyProtocol makes the routes selected by their listening address, in the format [tcp/][ip:]port,
+// expect a PROXY protocol header at the start of every connection
+func ApplyProxyProtocol(routes []Route, selectors []string) error {
+	for _, s := range selectors {
+		selector, err := parseRouteSelector(s)
+		if err != nil {
+			return fmt.Errorf("invalid proxy protocol route %s: %w", s, err)
+		}
+		if selector.network == "udp" {
+			return fmt.Errorf("the proxy protocol is only supported over tcp: %s", s)
+		}
+
+		matched := false
+		for i := range routes {
+			if routes[i].Network == "tcp" && selector.matches(&routes[i]) {
+				routes[i].ProxyProtocol = true
+				matched = true
+			}
+		}
+		if !matched {
+			return fmt.Errorf("no tcp route found for proxy protocol route: %s", s)
+		}
+	}
+
+	return nil
+}
+
+// ParseTrustedProxies parses the cidrs of the proxies which may send a PROXY protocol header
+func ParseTrustedProxies(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := parseClientPrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func (s *EntryPointServer) trustsProxy(addr netip.Addr) bool {
+	for _, prefix := range s.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleProxiedConnection reads the PROXY protocol header sent by the proxy in front of us,
+// and handles the connection with the address of the client
+func (s *EntryPointServer) HandleProxiedConnection(conn net.Conn) {
+	proxy, err := addrPortOf(conn.RemoteAddr())
+	if err != nil {
+		logger.Error("failed to parse the proxy address", slog.String(logging.KeyRemoteAddr, conn.RemoteAddr().String()), logging.Err(err))
+		conn.Close()
+		return
+	}
+	if !s.trustsProxy(proxy.Addr()) {
+		logger.Warn("proxy rejected, not trusted", slog.String(logging.KeyRemoteAddr, conn.RemoteAddr().String()))
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(constant.ProxyHeaderTimeout))
+	proxied, err := proxyproto.NewConn(conn)
+	if err != nil {
+		logger.Warn("failed to read the proxy protocol header", slog.String(logging.KeyRemoteAddr, conn.RemoteAddr().String()), logging.Err(err))
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	s.HandleConnection(proxied)
+}
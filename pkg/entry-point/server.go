@@ -1,45 +1,185 @@
 package entry_point
 
 import (
-	"crypto/x509"
-	"encoding/binary"
+	"crypto/tls"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
 
 	common "github.com/samlior/tcp-reverse-proxy/pkg/common"
 	"github.com/samlior/tcp-reverse-proxy/pkg/constant"
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+	"github.com/samlior/tcp-reverse-proxy/pkg/protocol"
+	"github.com/samlior/tcp-reverse-proxy/pkg/proxyproto"
 )
 
+var logger = logging.New("entry-point")
+
 type Route struct {
+	// "tcp" or "udp"
+	Network string
+
 	SrcHost string
 	SrcPort uint16
 
 	DstHost string
 	DstPort uint16
+
+	// bandwidth limits in bytes per second shared by the sessions of the route, zero means unlimited
+	UploadLimit   int
+	DownloadLimit int
+
+	// the clients which may use the route, every client is allowed if it is empty
+	AllowClients []netip.Prefix
+	// the clients which are always rejected
+	DenyClients []netip.Prefix
+
+	// the connections start with a PROXY protocol header carrying the address of the client
+	ProxyProtocol bool
+}
+
+// String returns the network and the listening address of the route
+func (r *Route) String() string {
+	return r.Network + "/" + net.JoinHostPort(r.SrcHost, strconv.Itoa(int(r.SrcPort)))
 }
 
 type EntryPointServer struct {
 	*common.KeepDialingServer
 
+	// the proxies which may send a PROXY protocol header, no proxy is trusted if it is empty
+	TrustedProxies []netip.Prefix
+
 	routes []Route
+	// bandwidth limit of every route, nil if it is unlimited
+	limits []*common.BandwidthLimit
 }
 
-func NewEntryPointServer(groupId uint8, serverAddress string, authPrivateKeyBytes []byte, certPool *x509.CertPool, routes []Route) *EntryPointServer {
-	ks := common.NewKeepDialingServer(groupId, false, serverAddress, authPrivateKeyBytes, certPool)
+func NewEntryPointServer(group string, serverAddresses []string, authPrivateKeyBytes []byte, tlsConfig *tls.Config, multiplex int, minPoolSize int, maxPoolSize int, routes []Route) *EntryPointServer {
+	ks := common.NewKeepDialingServer(group, false, serverAddresses, authPrivateKeyBytes, tlsConfig, multiplex, minPoolSize, maxPoolSize)
+	// the clients are accepted by ourselves
+	ks.ClientConnType = constant.ConnTypeUp
+
+	limits := make([]*common.BandwidthLimit, len(routes))
+	for i, route := range routes {
+		if route.UploadLimit > 0 || route.DownloadLimit > 0 {
+			limits[i] = common.NewBandwidthLimit("route "+route.String(), route.UploadLimit, route.DownloadLimit)
+			ks.AddLimit(limits[i])
+		}
+	}
 
 	return &EntryPointServer{
 		KeepDialingServer: ks,
 		routes:            routes,
+		limits:            limits,
+	}
+}
+
+// splitRoute splits the route by colons,
+// colons inside brackets are kept so that ipv6 literals can be written as [::1]
+func splitRoute(route string) ([]string, error) {
+	var parts []string
+	inBrackets := false
+	start := 0
+
+	for i, c := range route {
+		switch c {
+		case '[':
+			if inBrackets {
+				return nil, fmt.Errorf("unexpected '[' in route: %s", route)
+			}
+			inBrackets = true
+		case ']':
+			if !inBrackets {
+				return nil, fmt.Errorf("unexpected ']' in route: %s", route)
+			}
+			inBrackets = false
+		case ':':
+			if !inBrackets {
+				parts = append(parts, route[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if inBrackets {
+		return nil, fmt.Errorf("unclosed '[' in route: %s", route)
+	}
+
+	return append(parts, route[start:]), nil
+}
+
+// parseHost removes the brackets around ipv6 literals
+func parseHost(host string) (string, error) {
+	if strings.HasPrefix(host, "[") {
+		if !strings.HasSuffix(host, "]") {
+			return "", fmt.Errorf("invalid host: %s", host)
+		}
+
+		host = host[1 : len(host)-1]
+		ip := net.ParseIP(host)
+		if ip == nil || ip.To4() != nil {
+			return "", fmt.Errorf("invalid ipv6 address: %s", host)
+		}
+
+		return host, nil
+	}
+
+	if host == "" || len(host) > 255 || strings.ContainsAny(host, "[]") {
+		return "", fmt.Errorf("invalid host: %s", host)
+	}
+
+	return host, nil
+}
+
+// parseLimits parses the bandwidth limits of a route, either UPLOAD/DOWNLOAD or a single limit for both
+func parseLimits(limits string) (int, int, error) {
+	upload, download, ok := strings.Cut(limits, "/")
+	if !ok {
+		download = upload
+	}
+
+	uploadLimit, err := common.ParseBandwidth(upload)
+	if err != nil {
+		return 0, 0, err
 	}
+
+	downloadLimit, err := common.ParseBandwidth(download)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uploadLimit, downloadLimit, nil
 }
 
 func ParseRoutes(_routes []string) ([]Route, error) {
 	routes := make([]Route, len(_routes))
 
 	for i, route := range _routes {
-		parts := strings.Split(route, ":")
+		// the bandwidth limits follow an @
+		route, limits, hasLimits := strings.Cut(route, "@")
+		var uploadLimit, downloadLimit int
+		if hasLimits {
+			var err error
+			uploadLimit, downloadLimit, err = parseLimits(limits)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bandwidth limits of route %s: %w", route, err)
+			}
+		}
+
+		network := "tcp"
+		if strings.HasPrefix(route, "udp/") {
+			network = "udp"
+			route = strings.TrimPrefix(route, "udp/")
+		} else {
+			route = strings.TrimPrefix(route, "tcp/")
+		}
+
+		parts, err := splitRoute(route)
+		if err != nil {
+			return nil, err
+		}
 
 		if len(parts) <= 1 {
 			return nil, fmt.Errorf("invalid route: %s", route)
@@ -71,20 +211,26 @@ func ParseRoutes(_routes []string) ([]Route, error) {
 			srcPort, err = strconv.ParseUint(parts[0], 10, 16)
 			if err != nil {
 				// ip:port:port
-				srcHost = parts[0]
+				srcHost, err = parseHost(parts[0])
+				if err != nil {
+					return nil, err
+				}
 				srcPort, err = strconv.ParseUint(parts[1], 10, 16)
 				if err != nil {
-					return nil, fmt.Errorf("invalid source port: %s", parts[0])
+					return nil, fmt.Errorf("invalid source port: %s", parts[1])
 				}
 				dstHost = "127.0.0.1"
 				dstPort, err = strconv.ParseUint(parts[2], 10, 16)
 				if err != nil {
-					return nil, fmt.Errorf("invalid destination port: %s", parts[1])
+					return nil, fmt.Errorf("invalid destination port: %s", parts[2])
 				}
 			} else {
 				// port:ip:port
 				srcHost = "*"
-				dstHost = parts[1]
+				dstHost, err = parseHost(parts[1])
+				if err != nil {
+					return nil, err
+				}
 				dstPort, err = strconv.ParseUint(parts[2], 10, 16)
 				if err != nil {
 					return nil, fmt.Errorf("invalid destination port: %s", parts[2])
@@ -99,32 +245,59 @@ func ParseRoutes(_routes []string) ([]Route, error) {
 			}
 		} else if len(parts) == 4 {
 			// ip:port:ip:port
+			srcHost, err := parseHost(parts[0])
+			if err != nil {
+				return nil, err
+			}
+
 			srcPort, err := strconv.ParseUint(parts[1], 10, 16)
 			if err != nil {
 				return nil, fmt.Errorf("invalid source port: %s", parts[1])
 			}
 
+			dstHost, err := parseHost(parts[2])
+			if err != nil {
+				return nil, err
+			}
+
 			dstPort, err := strconv.ParseUint(parts[3], 10, 16)
 			if err != nil {
 				return nil, fmt.Errorf("invalid destination port: %s", parts[3])
 			}
 
 			routes[i] = Route{
-				SrcHost: parts[0],
+				SrcHost: srcHost,
 				SrcPort: uint16(srcPort),
-				DstHost: parts[2],
+				DstHost: dstHost,
 				DstPort: uint16(dstPort),
 			}
 		} else {
 			return nil, fmt.Errorf("invalid route: %s", route)
 		}
+
+		routes[i].Network = network
+		routes[i].UploadLimit = uploadLimit
+		routes[i].DownloadLimit = downloadLimit
 	}
 
 	return routes, nil
 }
 
+// sameHost compares two hosts, ip addresses are compared by value
+func sameHost(a, b string) bool {
+	ipA := net.ParseIP(a)
+	ipB := net.ParseIP(b)
+	if ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return a == b
+}
+
 func (s *EntryPointServer) HandleConnection(conn net.Conn) {
 	s.CommonServer.HandleConnection(conn, constant.ConnTypeUp, func(conn *common.Conn) error {
+		// the client waits for a connection to the relay server from now on
+		conn.Client = true
+
 		localAddr := conn.Conn.LocalAddr().String()
 		host, strPort, err := net.SplitHostPort(localAddr)
 		if err != nil {
@@ -139,9 +312,12 @@ func (s *EntryPointServer) HandleConnection(conn net.Conn) {
 		port := uint16(uint64Port)
 
 		var route *Route
-		for _, r := range s.routes {
-			if (r.SrcHost == "*" || r.SrcHost == host) && r.SrcPort == port {
+		for i, r := range s.routes {
+			if r.Network == conn.Conn.LocalAddr().Network() && (r.SrcHost == "*" || sameHost(r.SrcHost, host)) && r.SrcPort == port {
 				route = &r
+				if s.limits[i] != nil {
+					conn.Limits = append(conn.Limits, s.limits[i])
+				}
 				break
 			}
 		}
@@ -149,22 +325,57 @@ func (s *EntryPointServer) HandleConnection(conn net.Conn) {
 			return fmt.Errorf("no route found for %s:%d", host, port)
 		}
 
-		dstHostBytes := net.ParseIP(route.DstHost)
-		if dstHostBytes.To4() != nil {
-			// ipv4
-			dstHostBytes = dstHostBytes.To4()
-			// fill with 0
-			dstHostBytes = append(make([]byte, 16-len(dstHostBytes)), []byte(dstHostBytes)...)
-		} else {
-			// ipv6
-			dstHostBytes = dstHostBytes.To16()
+		client, err := addrPortOf(conn.Conn.RemoteAddr())
+		if err != nil {
+			return err
+		}
+		if !route.AcceptsClient(client.Addr()) {
+			logger.Warn("client rejected", conn.LogAttrs(slog.String("listener", route.String()))...)
+			return fmt.Errorf("client %s is not allowed to use route %s", client.Addr(), route)
 		}
 
-		dstPostBytes := make([]byte, 2)
-		binary.BigEndian.PutUint16(dstPostBytes, route.DstPort)
+		listener, err := addrPortOf(conn.Conn.LocalAddr())
+		if err != nil {
+			return err
+		}
+		// the client connected to the proxy in front of us
+		if proxied, ok := conn.Conn.(*proxyproto.Conn); ok && proxied.Header().Destination.IsValid() {
+			destination := proxied.Header().Destination
+			listener = netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port())
+		}
+
+		network := protocol.NetworkTCP
+		if route.Network == "udp" {
+			network = protocol.NetworkUDP
+		}
+
+		r := &protocol.Route{
+			Network: network,
+			Destination: protocol.Address{
+				Host: route.DstHost,
+				Port: route.DstPort,
+			},
+			Source: protocol.Address{
+				Host: client.Addr().String(),
+				Port: client.Port(),
+			},
+			Listener: protocol.Address{
+				Host: listener.Addr().String(),
+				Port: listener.Port(),
+			},
+		}
+		conn.RouteName = r.String()
+
+		payload, err := r.Marshal()
+		if err != nil {
+			return err
+		}
 
 		// set route information
-		conn.Route = append([]byte(dstHostBytes), dstPostBytes...)
+		conn.Route, err = protocol.EncodeMessage(protocol.MessageTypeRoute, payload)
+		if err != nil {
+			return err
+		}
 
 		return nil
 	})
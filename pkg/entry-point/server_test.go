@@ -0,0 +1,70 @@
+package entry_point
+
+import "testing"
+
+func TestParseRoutes(t *testing.T) {
+	for _, test := range []struct {
+		route    string
+		expected Route
+	}{
+		{"80:81", Route{Network: "tcp", SrcHost: "*", SrcPort: 80, DstHost: "127.0.0.1", DstPort: 81}},
+		{"tcp/80:81", Route{Network: "tcp", SrcHost: "*", SrcPort: 80, DstHost: "127.0.0.1", DstPort: 81}},
+		{"udp/53:54", Route{Network: "udp", SrcHost: "*", SrcPort: 53, DstHost: "127.0.0.1", DstPort: 54}},
+		{"0.0.0.0:80:81", Route{Network: "tcp", SrcHost: "0.0.0.0", SrcPort: 80, DstHost: "127.0.0.1", DstPort: 81}},
+		{"80:example.com:81", Route{Network: "tcp", SrcHost: "*", SrcPort: 80, DstHost: "example.com", DstPort: 81}},
+		{"80:[::1]:81", Route{Network: "tcp", SrcHost: "*", SrcPort: 80, DstHost: "::1", DstPort: 81}},
+		{"[::]:80:81", Route{Network: "tcp", SrcHost: "::", SrcPort: 80, DstHost: "127.0.0.1", DstPort: 81}},
+		{"[::1]:80:[::1]:81", Route{Network: "tcp", SrcHost: "::1", SrcPort: 80, DstHost: "::1", DstPort: 81}},
+		{"udp/[fe80::1]:53:10.0.0.1:54", Route{Network: "udp", SrcHost: "fe80::1", SrcPort: 53, DstHost: "10.0.0.1", DstPort: 54}},
+		{"80:81@1M", Route{Network: "tcp", SrcHost: "*", SrcPort: 80, DstHost: "127.0.0.1", DstPort: 81, UploadLimit: 1 << 20, DownloadLimit: 1 << 20}},
+		{"udp/[::1]:80:[::1]:81@1M/2K", Route{Network: "udp", SrcHost: "::1", SrcPort: 80, DstHost: "::1", DstPort: 81, UploadLimit: 1 << 20, DownloadLimit: 2 << 10}},
+	} {
+		routes, err := ParseRoutes([]string{test.route})
+		if err != nil {
+			t.Fatalf("%s: %v", test.route, err)
+		}
+		if len(routes) != 1 || routes[0].String() != test.expected.String() || routes[0].DstHost != test.expected.DstHost ||
+			routes[0].DstPort != test.expected.DstPort || routes[0].UploadLimit != test.expected.UploadLimit ||
+			routes[0].DownloadLimit != test.expected.DownloadLimit {
+			t.Fatalf("%s: expected %+v, got %+v", test.route, test.expected, routes)
+		}
+	}
+}
+
+func TestParseRoutesMalformed(t *testing.T) {
+	for _, route := range []string{
+		"",
+		"80",
+		"80:",
+		"80:81:82:83:84",
+		"80:65536",
+		"x:81",
+		"80:example.com:x",
+		"udp/80",
+		"sctp/80:81",
+		"udp/tcp/80:81",
+		// brackets
+		"[::1:80:81",
+		"::1]:80:81",
+		"[[::1]]:80:81",
+		"[::1]x:80:81",
+		"80:[::1]",
+		"[127.0.0.1]:80:81",
+		"[example.com]:80:81",
+		"[]:80:81",
+		"80:[::1]:81:82",
+		// limits
+		"80:81@",
+		"80:81@x",
+		"80:81@1M/",
+		"80:81@/1M",
+		"80:81@1M/2M/3M",
+		"80:81@1M@2M",
+		"80:81@-1",
+		"@1M",
+	} {
+		if routes, err := ParseRoutes([]string{route}); err == nil {
+			t.Fatalf("%q: expected an error, got %+v", route, routes)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// keys of the fields shared by every component
+const (
+	KeyComponent  = "component"
+	KeyConnId     = "conn_id"
+	KeyPeerId     = "peer_id"
+	KeyGroup      = "group"
+	KeyRemoteAddr = "remote_addr"
+	KeyRoute      = "route"
+	KeyError      = "error"
+)
+
+// Setup replaces the default logger, the level is debug, info, warn or error,
+// the format is text or json, the output of the log package goes through it as well
+func Setup(level string, format string) error {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("invalid log level: %s", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case FormatText:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format: %s", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// New returns the logger of a component,
+// it can be created before Setup is called since it always writes to the current default logger
+func New(component string) *slog.Logger {
+	return slog.New(&defaultHandler{}).With(KeyComponent, component)
+}
+
+// Err is the field of an error
+func Err(err error) slog.Attr {
+	return slog.Any(KeyError, err)
+}
+
+// Fatal logs the message as an error and exits
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// defaultHandler passes the records to the handler of the default logger,
+// after replaying the fields and the groups added to the logger
+type defaultHandler struct {
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *defaultHandler) handler() slog.Handler {
+	handler := slog.Default().Handler()
+	for _, with := range h.with {
+		handler = with(handler)
+	}
+	return handler
+}
+
+func (h *defaultHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, level)
+}
+
+func (h *defaultHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler().Handle(ctx, record)
+}
+
+func (h *defaultHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.append(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *defaultHandler) WithGroup(name string) slog.Handler {
+	return h.append(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+func (h *defaultHandler) append(with func(slog.Handler) slog.Handler) slog.Handler {
+	return &defaultHandler{with: append(h.with[:len(h.with):len(h.with)], with)}
+}
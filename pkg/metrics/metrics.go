@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// prefix of every metric
+const Namespace = "tcp_reverse_proxy"
+
+// the metrics of events are recorded whether they are served or not,
+// the state of the servers is collected when the metrics are scraped
+var (
+	PairingLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "pairing_latency_seconds",
+		Help:      "Time a connection carrying a session waited for its partner.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"group"})
+
+	TransferredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "transferred_bytes_total",
+		Help:      "Bytes forwarded between connected connections, upload is the data sent by the clients of the entry-point.",
+	}, []string{"group", "route", "direction"})
+
+	HandshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "handshake_failures_total",
+		Help:      "Clients of the relay server which failed to authenticate.",
+	}, []string{"reason"})
+
+	RelayDialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "relay_dial_errors_total",
+		Help:      "Failed attempts to connect to a relay server.",
+	}, []string{"relay"})
+)
+
+// Serve serves the metrics over http at /metrics until it fails,
+// along with the state collected from the servers
+func Serve(address string, servers ...prometheus.Collector) error {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		PairingLatency,
+		TransferredBytes,
+		HandshakeFailures,
+		RelayDialErrors,
+	)
+	for _, server := range servers {
+		err := registry.Register(server)
+		if err != nil {
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	return http.ListenAndServe(address, mux)
+}
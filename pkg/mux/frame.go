@@ -0,0 +1,70 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// every frame is encoded as:
+//
+//	type(1) | stream id(4) | length(4) | payload
+//
+// for window update frames the length field carries the window increment
+// and there is no payload
+const headerSize = 1 + 4 + 4
+
+const (
+	// open a new stream
+	frameOpen uint8 = iota + 1
+	// stream data
+	frameData
+	// grant more receive window to the peer
+	frameWindowUpdate
+	// the sender will not send any more data (half close)
+	frameFin
+	// abort the stream
+	frameReset
+)
+
+const (
+	// initial receive window of every stream
+	initialWindow = 256 * 1024
+	// maximum payload of a single data frame
+	maxFrameSize = 16 * 1024
+)
+
+type header struct {
+	typ      uint8
+	streamId uint32
+	length   uint32
+}
+
+func readHeader(r io.Reader, buffer []byte) (header, error) {
+	if _, err := io.ReadFull(r, buffer[:headerSize]); err != nil {
+		return header{}, err
+	}
+
+	h := header{
+		typ:      buffer[0],
+		streamId: binary.BigEndian.Uint32(buffer[1:5]),
+		length:   binary.BigEndian.Uint32(buffer[5:9]),
+	}
+	if h.typ < frameOpen || h.typ > frameReset {
+		return header{}, fmt.Errorf("invalid frame type: %d", h.typ)
+	}
+	if h.typ == frameData && h.length > maxFrameSize {
+		return header{}, fmt.Errorf("frame too large: %d", h.length)
+	}
+
+	return h, nil
+}
+
+func encodeFrame(typ uint8, streamId uint32, length uint32, payload []byte) []byte {
+	buffer := make([]byte, headerSize+len(payload))
+	buffer[0] = typ
+	binary.BigEndian.PutUint32(buffer[1:5], streamId)
+	binary.BigEndian.PutUint32(buffer[5:9], length)
+	copy(buffer[headerSize:], payload)
+	return buffer
+}
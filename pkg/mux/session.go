@@ -0,0 +1,299 @@
+package mux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+var (
+	// wrap net.ErrClosed so that callers can treat them like closed connections
+	ErrSessionClosed = fmt.Errorf("session closed: %w", net.ErrClosed)
+	ErrStreamClosed  = fmt.Errorf("stream closed: %w", net.ErrClosed)
+	ErrStreamReset   = errors.New("stream reset by peer")
+)
+
+// accept backlog of a session,
+// new streams are reset when it is full
+const acceptBacklog = 256
+
+// Session multiplexes many logical streams over a single connection,
+// every stream has its own flow control window
+// so that a slow stream does not stall the others
+type Session struct {
+	conn net.Conn
+
+	lock     sync.Mutex
+	nextId   uint32
+	streams  map[uint32]*Stream
+	acceptCh chan *Stream
+
+	writeLock sync.Mutex
+
+	// fin and reset frames waiting for the control writer,
+	// so that closing a stream never blocks on a backpressured connection
+	control      [][]byte
+	controlReady chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Client creates the session on the side which dialed the connection
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1)
+}
+
+// Server creates the session on the side which accepted the connection
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 2)
+}
+
+func newSession(conn net.Conn, firstId uint32) *Session {
+	s := &Session{
+		conn:         conn,
+		nextId:       firstId,
+		streams:      make(map[uint32]*Stream),
+		acceptCh:     make(chan *Stream, acceptBacklog),
+		controlReady: make(chan struct{}, 1),
+		closed:       make(chan struct{}),
+	}
+
+	go s.recvLoop()
+	go s.controlLoop()
+
+	return s
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// NumStreams returns the number of live streams
+func (s *Session) NumStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.streams)
+}
+
+// Closed returns a channel which is closed when the session is closed
+func (s *Session) Closed() <-chan struct{} {
+	return s.closed
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Open opens a new stream
+func (s *Session) Open() (*Stream, error) {
+	s.lock.Lock()
+	if s.IsClosed() {
+		s.lock.Unlock()
+		return nil, ErrSessionClosed
+	}
+
+	id := s.nextId
+	s.nextId += 2
+
+	stream := newStream(id, s)
+	s.streams[id] = stream
+	s.lock.Unlock()
+
+	err := s.writeFrame(frameOpen, id, 0, nil)
+	if err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// Accept waits for the next stream opened by the peer
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case <-s.closed:
+		return nil, s.closeErr()
+	case stream := <-s.acceptCh:
+		return stream, nil
+	}
+}
+
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.lock.Lock()
+		s.err = err
+		close(s.closed)
+		s.lock.Unlock()
+
+		s.conn.Close()
+	})
+}
+
+func (s *Session) closeErr() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.err
+}
+
+func (s *Session) writeFrame(typ uint8, streamId uint32, length uint32, payload []byte) error {
+	return s.write(encodeFrame(typ, streamId, length, payload))
+}
+
+func (s *Session) write(frame []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.IsClosed() {
+		return s.closeErr()
+	}
+
+	_, err := s.conn.Write(frame)
+	if err != nil {
+		s.closeWithError(err)
+		return err
+	}
+
+	return nil
+}
+
+// queueFrame queues a frame without payload for the control writer, it never blocks
+func (s *Session) queueFrame(typ uint8, streamId uint32) {
+	s.lock.Lock()
+	s.control = append(s.control, encodeFrame(typ, streamId, 0, nil))
+	s.lock.Unlock()
+
+	notify(s.controlReady)
+}
+
+// controlLoop writes the queued frames in order until the session is closed
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.controlReady:
+		}
+
+		s.lock.Lock()
+		frames := s.control
+		s.control = nil
+		s.lock.Unlock()
+
+		for _, frame := range frames {
+			if s.write(frame) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.streams, id)
+}
+
+func (s *Session) recvLoop() {
+	buffer := make([]byte, headerSize)
+
+	for {
+		h, err := readHeader(s.conn, buffer)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				err = ErrSessionClosed
+			}
+			s.closeWithError(err)
+			return
+		}
+
+		err = s.handleFrame(h)
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(h header) error {
+	switch h.typ {
+	case frameOpen:
+		return s.handleOpen(h.streamId)
+	case frameData:
+		data := make([]byte, h.length)
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			return err
+		}
+
+		stream := s.getStream(h.streamId)
+		if stream == nil {
+			// the stream has been closed locally,
+			// tell the peer to stop sending
+			s.queueFrame(frameReset, h.streamId)
+			return nil
+		}
+		return stream.pushData(data)
+	case frameWindowUpdate:
+		if stream := s.getStream(h.streamId); stream != nil {
+			return stream.growSendWindow(h.length)
+		}
+	case frameFin:
+		if stream := s.getStream(h.streamId); stream != nil {
+			stream.remoteFin()
+		}
+	case frameReset:
+		if stream := s.getStream(h.streamId); stream != nil {
+			stream.remoteReset()
+		}
+	}
+
+	return nil
+}
+
+func (s *Session) handleOpen(id uint32) error {
+	s.lock.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.lock.Unlock()
+		return fmt.Errorf("duplicate stream id: %d", id)
+	}
+
+	stream := newStream(id, s)
+	s.streams[id] = stream
+	s.lock.Unlock()
+
+	select {
+	case s.acceptCh <- stream:
+	default:
+		// the accept backlog is full
+		stream.Reset()
+	}
+
+	return nil
+}
@@ -0,0 +1,259 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sessionPipe(t *testing.T) (*Session, *Session) {
+	a, b := net.Pipe()
+	client, server := Client(a), Server(b)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func openPair(t *testing.T, client *Session, server *Session) (*Stream, *Stream) {
+	t.Helper()
+
+	local, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.Id() != local.Id() {
+		t.Fatalf("expected stream %d, got %d", local.Id(), remote.Id())
+	}
+	return local, remote
+}
+
+// rawServer returns a server session and the raw connection of its peer,
+// everything the session writes is discarded
+func rawServer(t *testing.T) (*Session, net.Conn) {
+	a, b := net.Pipe()
+	server := Server(b)
+	t.Cleanup(func() {
+		server.Close()
+		a.Close()
+	})
+	go io.Copy(io.Discard, a)
+	return server, a
+}
+
+func waitClosed(t *testing.T, session *Session, reason string) {
+	t.Helper()
+
+	select {
+	case <-session.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session has not been closed")
+	}
+	if err := session.closeErr(); err == nil || !strings.Contains(err.Error(), reason) {
+		t.Fatalf("expected an error about %q, got %v", reason, err)
+	}
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	client, server := sessionPipe(t)
+	local, remote := openPair(t, client, server)
+
+	// several times the window, so that it must be granted back
+	data := bytes.Repeat([]byte("data"), initialWindow)
+	errs := make(chan error, 1)
+	go func() {
+		if _, err := local.Write(data); err != nil {
+			errs <- err
+			return
+		}
+		errs <- local.CloseWrite()
+	}()
+
+	received, err := io.ReadAll(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("expected %d bytes, got %d", len(data), len(received))
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := local.Write([]byte("more")); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("expected %v, got %v", ErrStreamClosed, err)
+	}
+
+	// the other direction is still open
+	go func() {
+		if _, err := remote.Write([]byte("reply")); err != nil {
+			errs <- err
+			return
+		}
+		errs <- remote.Close()
+	}()
+
+	received, err = io.ReadAll(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != "reply" {
+		t.Fatalf("expected reply, got %q", received)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	client, server := sessionPipe(t)
+	local, remote := openPair(t, client, server)
+
+	// the peer does not read, the writer stops once the window is used up
+	local.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := local.Write(make([]byte, initialWindow+1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", os.ErrDeadlineExceeded, err)
+	}
+	if n != initialWindow {
+		t.Fatalf("expected %d bytes written, got %d", initialWindow, n)
+	}
+
+	// reading half of the window grants it back
+	if _, err := io.ReadFull(remote, make([]byte, initialWindow/2)); err != nil {
+		t.Fatal(err)
+	}
+	local.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := local.Write(make([]byte, initialWindow/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a slow stream does not stall the others
+	other, otherRemote := openPair(t, client, server)
+	go other.Write([]byte("other"))
+	buffer := make([]byte, 5)
+	if _, err := io.ReadFull(otherRemote, buffer); err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer) != "other" {
+		t.Fatalf("expected other, got %q", buffer)
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	client, server := sessionPipe(t)
+	local, remote := openPair(t, client, server)
+
+	if err := remote.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("expected %v, got %v", ErrStreamReset, err)
+	}
+
+	if _, err := local.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("expected %v, got %v", ErrStreamReset, err)
+	}
+	if _, err := local.Write([]byte("data")); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("expected %v, got %v", ErrStreamReset, err)
+	}
+
+	// the session survives the reset of a stream
+	openPair(t, client, server)
+	if n := client.NumStreams(); n != 1 {
+		t.Fatalf("expected 1 stream, got %d", n)
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := sessionPipe(t)
+	local, remote := openPair(t, client, server)
+
+	if err := local.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.Read(make([]byte, 1)); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("expected %v, got %v", ErrStreamClosed, err)
+	}
+
+	if _, err := io.ReadAll(remote); err != nil {
+		t.Fatalf("expected an end of file, got %v", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := sessionPipe(t)
+	local, remote := openPair(t, client, server)
+
+	client.Close()
+
+	if _, err := remote.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v, got %v", net.ErrClosed, err)
+	}
+	if _, err := local.Write([]byte("data")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected %v, got %v", net.ErrClosed, err)
+	}
+	if _, err := client.Open(); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("expected %v, got %v", ErrSessionClosed, err)
+	}
+}
+
+func TestSessionSendWindowOverflow(t *testing.T) {
+	for _, increment := range []uint32{1, initialWindow, 1<<32 - 1} {
+		server, peer := rawServer(t)
+
+		peer.Write(encodeFrame(frameOpen, 1, 0, nil))
+		if _, err := server.Accept(); err != nil {
+			t.Fatal(err)
+		}
+
+		// nothing has been sent, the window is already full
+		peer.Write(encodeFrame(frameWindowUpdate, 1, increment, nil))
+		waitClosed(t, server, "send window")
+	}
+}
+
+func TestSessionRecvWindowOverflow(t *testing.T) {
+	server, peer := rawServer(t)
+
+	peer.Write(encodeFrame(frameOpen, 1, 0, nil))
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream is not read, the peer sends past the window
+	payload := make([]byte, maxFrameSize)
+	for sent := 0; sent <= initialWindow; sent += len(payload) {
+		if _, err := peer.Write(encodeFrame(frameData, 1, uint32(len(payload)), payload)); err != nil {
+			break
+		}
+	}
+	waitClosed(t, server, "receive window")
+}
+
+func TestSessionInvalidFrames(t *testing.T) {
+	for _, frame := range [][]byte{
+		encodeFrame(frameReset+1, 1, 0, nil),
+		encodeFrame(frameData, 1, maxFrameSize+1, nil),
+	} {
+		server, peer := rawServer(t)
+
+		peer.Write(frame)
+		waitClosed(t, server, "frame")
+	}
+
+	server, peer := rawServer(t)
+	peer.Write(encodeFrame(frameOpen, 1, 0, nil))
+	peer.Write(encodeFrame(frameOpen, 1, 0, nil))
+	waitClosed(t, server, "duplicate stream")
+}
@@ -0,0 +1,316 @@
+package mux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection inside a session,
+// it implements net.Conn
+type Stream struct {
+	id      uint32
+	session *Session
+
+	lock sync.Mutex
+
+	// received but not yet read data frames,
+	// frame boundaries are kept like tls records
+	recvBuffer [][]byte
+	// bytes received but not yet granted back to the peer
+	recvPending uint32
+	// bytes read but not yet granted back to the peer
+	recvUnacked uint32
+	// bytes we are still allowed to send
+	sendWindow uint32
+
+	finSent     bool
+	finReceived bool
+	reset       bool
+	closed      bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readReady  chan struct{}
+	writeReady chan struct{}
+}
+
+func newStream(id uint32, session *Session) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		sendWindow: initialWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.closed:
+		return st.session.closeErr()
+	}
+}
+
+func (st *Stream) Id() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.lock.Lock()
+		if st.reset {
+			st.lock.Unlock()
+			return 0, ErrStreamReset
+		}
+		if st.closed {
+			st.lock.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if len(st.recvBuffer) > 0 {
+			n := copy(b, st.recvBuffer[0])
+			if n == len(st.recvBuffer[0]) {
+				st.recvBuffer[0] = nil
+				st.recvBuffer = st.recvBuffer[1:]
+			} else {
+				st.recvBuffer[0] = st.recvBuffer[0][n:]
+			}
+			st.recvUnacked += uint32(n)
+
+			// grant the window back once half of it has been consumed
+			var increment uint32
+			if st.recvUnacked >= initialWindow/2 && !st.finReceived {
+				increment = st.recvUnacked
+				st.recvPending -= increment
+				st.recvUnacked = 0
+			}
+			st.lock.Unlock()
+
+			if increment > 0 {
+				st.session.writeFrame(frameWindowUpdate, st.id, increment, nil)
+			}
+			return n, nil
+		}
+		if st.finReceived {
+			st.lock.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.lock.Unlock()
+
+		if err := st.wait(st.readReady, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+
+	for written < len(b) {
+		st.lock.Lock()
+		if st.reset {
+			st.lock.Unlock()
+			return written, ErrStreamReset
+		}
+		if st.closed || st.finSent {
+			st.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.lock.Unlock()
+
+			if err := st.wait(st.writeReady, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		n := min(uint32(len(b)-written), st.sendWindow, maxFrameSize)
+		st.sendWindow -= n
+		st.lock.Unlock()
+
+		err := st.session.writeFrame(frameData, st.id, n, b[written:written+int(n)])
+		if err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+
+	return written, nil
+}
+
+// CloseWrite sends a fin to the peer,
+// the stream can still be read until the peer closes its side
+func (st *Stream) CloseWrite() error {
+	st.lock.Lock()
+	if st.closed || st.reset || st.finSent {
+		st.lock.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finReceived
+	st.lock.Unlock()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+
+	return st.session.writeFrame(frameFin, st.id, 0, nil)
+}
+
+func (st *Stream) Close() error {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	needFin := !st.finSent && !st.reset
+	st.finSent = true
+	st.lock.Unlock()
+
+	notify(st.readReady)
+	notify(st.writeReady)
+	st.session.removeStream(st.id)
+
+	// the fin is sent by the control writer, a closing stream never waits for a busy session
+	if needFin {
+		st.session.queueFrame(frameFin, st.id)
+	}
+	return nil
+}
+
+// Reset aborts the stream, the peer will receive ErrStreamReset
+func (st *Stream) Reset() error {
+	st.lock.Lock()
+	if st.closed || st.reset {
+		st.lock.Unlock()
+		return nil
+	}
+	st.reset = true
+	st.closed = true
+	st.lock.Unlock()
+
+	notify(st.readReady)
+	notify(st.writeReady)
+	st.session.removeStream(st.id)
+
+	st.session.queueFrame(frameReset, st.id)
+	return nil
+}
+
+func (st *Stream) pushData(data []byte) error {
+	st.lock.Lock()
+	if st.recvPending+uint32(len(data)) > initialWindow {
+		st.lock.Unlock()
+		return errors.New("peer exceeded the receive window")
+	}
+	if st.closed || st.finReceived {
+		// drop the data
+		st.lock.Unlock()
+		return nil
+	}
+	st.recvPending += uint32(len(data))
+	st.recvBuffer = append(st.recvBuffer, data)
+	st.lock.Unlock()
+
+	notify(st.readReady)
+	return nil
+}
+
+func (st *Stream) growSendWindow(increment uint32) error {
+	st.lock.Lock()
+	// the peer only grants back what we sent, the window never grows past its initial size
+	if increment > initialWindow-st.sendWindow {
+		st.lock.Unlock()
+		return errors.New("peer exceeded the send window")
+	}
+	st.sendWindow += increment
+	st.lock.Unlock()
+
+	notify(st.writeReady)
+	return nil
+}
+
+func (st *Stream) remoteFin() {
+	st.lock.Lock()
+	st.finReceived = true
+	done := st.finSent
+	st.lock.Unlock()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+	notify(st.readReady)
+}
+
+func (st *Stream) remoteReset() {
+	st.lock.Lock()
+	st.reset = true
+	st.lock.Unlock()
+
+	st.session.removeStream(st.id)
+	notify(st.readReady)
+	notify(st.writeReady)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.readDeadline = t
+	st.lock.Unlock()
+
+	// wake up the reader so that it picks up the new deadline
+	notify(st.readReady)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.writeDeadline = t
+	st.lock.Unlock()
+
+	notify(st.writeReady)
+	return nil
+}
@@ -0,0 +1,314 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// the client is a reverse-proxy
+	RoleUp uint8 = 0x01
+	// the client is an entry-point
+	RoleDown uint8 = 0x02
+)
+
+// the auth payload is a list of fields encoded as:
+//
+//	tag(1) | length(2) | value(length)
+//
+// unknown fields are ignored so that new fields can be added
+// without breaking older relay servers
+const (
+	fieldRole uint8 = iota + 1
+	// legacy numeric group, superseded by fieldGroup
+	fieldGroupId
+	fieldSignature
+	fieldMultiplex
+	fieldPublicKey
+	fieldGroup
+	fieldInstance
+	fieldWeight
+	fieldFraming
+)
+
+// the longest group name in bytes
+const MaxGroupSize = 64
+
+// the longest instance id in bytes
+const MaxInstanceSize = 64
+
+// the signature covers the keying material exported from the tls session,
+// so that it can not be relayed to another channel
+const (
+	exporterLabel  = "EXPORTER-tcp-reverse-proxy-auth"
+	exporterLength = 32
+	signatureLabel = "tcp-reverse-proxy auth\x00"
+)
+
+type Auth struct {
+	Role      uint8
+	Group     string
+	Signature []byte
+	// the connection carries a multiplexed session instead of a single stream
+	Multiplex bool
+	// used by the relay server to find the authorized key
+	PublicKey []byte
+	// identifies the client process, so that the relay server can tell apart
+	// several clients sharing the same key
+	Instance string
+	// relative share of the connections the client should receive, zero means the default
+	Weight uint16
+	// the client frames the data of a connection which is not multiplexed if the relay server agrees
+	Framing bool
+
+	// every field before the signature, they are covered by the signature
+	claims []byte
+}
+
+// Marshal encodes every field except the signature,
+// it is used as is when the client is authenticated by its tls certificate
+func (a *Auth) Marshal() []byte {
+	var payload []byte
+	payload = appendField(payload, fieldRole, []byte{a.Role})
+	payload = appendField(payload, fieldGroup, []byte(a.Group))
+	// keep older relay servers working with numeric groups
+	if groupId, err := strconv.ParseUint(a.Group, 10, 8); err == nil && strconv.Itoa(int(groupId)) == a.Group {
+		payload = appendField(payload, fieldGroupId, []byte{uint8(groupId)})
+	}
+	if a.Multiplex {
+		payload = appendField(payload, fieldMultiplex, []byte{1})
+	}
+	if a.PublicKey != nil {
+		payload = appendField(payload, fieldPublicKey, a.PublicKey)
+	}
+	if a.Instance != "" {
+		payload = appendField(payload, fieldInstance, []byte(a.Instance))
+	}
+	if a.Weight != 0 {
+		payload = appendField(payload, fieldWeight, binary.BigEndian.AppendUint16(nil, a.Weight))
+	}
+	if a.Framing {
+		payload = appendField(payload, fieldFraming, []byte{1})
+	}
+	return payload
+}
+
+func signedData(state tls.ConnectionState, challenge []byte, claims []byte) ([]byte, error) {
+	keyingMaterial, err := state.ExportKeyingMaterial(exporterLabel, challenge, exporterLength)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, len(signatureLabel)+len(keyingMaterial)+len(challenge)+len(claims))
+	data = append(data, signatureLabel...)
+	data = append(data, keyingMaterial...)
+	data = append(data, challenge...)
+	return append(data, claims...), nil
+}
+
+// Sign signs the claims for the tls channel and returns the encoded auth,
+// the signature is always the last field
+func (a *Auth) Sign(privateKey ed25519.PrivateKey, state tls.ConnectionState, challenge []byte) ([]byte, error) {
+	claims := a.Marshal()
+
+	data, err := signedData(state, challenge, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	a.Signature = ed25519.Sign(privateKey, data)
+	a.claims = claims
+
+	return appendField(claims, fieldSignature, a.Signature), nil
+}
+
+// Verify verifies the signature against the claims received through the tls channel
+func (a *Auth) Verify(publicKey ed25519.PublicKey, state tls.ConnectionState, challenge []byte) bool {
+	data, err := signedData(state, challenge, a.claims)
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(publicKey, data, a.Signature)
+}
+
+func UnmarshalAuth(payload []byte) (*Auth, error) {
+	fields, err := parseFields(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// the signature is optional, but it must be the last field when present,
+	// everything before it is covered by the signature
+	claims := payload
+	signature, ok := fields[fieldSignature]
+	if ok {
+		signatureField := 3 + ed25519.SignatureSize
+		if len(signature) != ed25519.SignatureSize || len(payload) < signatureField || payload[len(payload)-signatureField] != fieldSignature || !bytes.Equal(signature, payload[len(payload)-ed25519.SignatureSize:]) {
+			return nil, errors.New("malformed signature, it must be the last field")
+		}
+		claims = payload[:len(payload)-signatureField]
+	}
+
+	role, ok := fields[fieldRole]
+	if !ok || len(role) != 1 {
+		return nil, errors.New("missing or malformed role")
+	}
+	if role[0] != RoleUp && role[0] != RoleDown {
+		return nil, fmt.Errorf("invalid role: %d", role[0])
+	}
+
+	// older clients only send a numeric group id,
+	// which is the same as the group named after its decimal form
+	var group string
+	if value, ok := fields[fieldGroup]; ok {
+		group = string(value)
+		err = ValidateGroup(group)
+		if err != nil {
+			return nil, err
+		}
+	} else if groupId, ok := fields[fieldGroupId]; ok && len(groupId) == 1 {
+		group = strconv.Itoa(int(groupId[0]))
+	} else {
+		return nil, errors.New("missing or malformed group")
+	}
+
+	multiplex, ok := fields[fieldMultiplex]
+	if ok && len(multiplex) != 1 {
+		return nil, errors.New("malformed multiplex flag")
+	}
+
+	publicKey, ok := fields[fieldPublicKey]
+	if ok && len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("malformed public key")
+	}
+
+	instance := fields[fieldInstance]
+	if len(instance) > MaxInstanceSize || !utf8.Valid(instance) || bytes.IndexFunc(instance, unicode.IsControl) >= 0 {
+		return nil, errors.New("malformed instance")
+	}
+
+	var weight uint16
+	if value, ok := fields[fieldWeight]; ok {
+		if len(value) != 2 {
+			return nil, errors.New("malformed weight")
+		}
+		weight = binary.BigEndian.Uint16(value)
+	}
+
+	framing, ok := fields[fieldFraming]
+	if ok && len(framing) != 1 {
+		return nil, errors.New("malformed framing flag")
+	}
+
+	return &Auth{
+		Role:      role[0],
+		Group:     group,
+		Signature: signature,
+		Multiplex: multiplex != nil && multiplex[0] != 0,
+		PublicKey: publicKey,
+		Instance:  string(instance),
+		Weight:    weight,
+		Framing:   framing != nil && framing[0] != 0,
+		claims:    claims,
+	}, nil
+}
+
+// Framed returns whether the data of the connection is framed once accepted,
+// a multiplexed session has frames of its own
+func (a *Auth) Framed() bool {
+	return a.Framing && !a.Multiplex
+}
+
+// the accept payload is a list of fields like the auth payload,
+// older relay servers send an empty payload
+const (
+	acceptFieldFraming uint8 = iota + 1
+)
+
+// Accept is the answer of the relay server to a successful auth
+type Accept struct {
+	// the data of the connection is framed from now on
+	Framing bool
+}
+
+func (a *Accept) Marshal() []byte {
+	var payload []byte
+	if a.Framing {
+		payload = appendField(payload, acceptFieldFraming, []byte{1})
+	}
+	return payload
+}
+
+func UnmarshalAccept(payload []byte) (*Accept, error) {
+	fields, err := parseFields(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	framing, ok := fields[acceptFieldFraming]
+	if ok && len(framing) != 1 {
+		return nil, errors.New("malformed framing flag")
+	}
+
+	return &Accept{
+		Framing: framing != nil && framing[0] != 0,
+	}, nil
+}
+
+// ValidateGroup checks that the group name is a non-empty utf-8 string
+// of at most MaxGroupSize bytes without control characters
+func ValidateGroup(group string) error {
+	if group == "" {
+		return errors.New("empty group")
+	}
+	if len(group) > MaxGroupSize {
+		return fmt.Errorf("group longer than %d bytes", MaxGroupSize)
+	}
+	if !utf8.ValidString(group) {
+		return errors.New("group is not valid utf-8")
+	}
+	for _, r := range group {
+		if unicode.IsControl(r) {
+			return errors.New("group contains control characters")
+		}
+	}
+	return nil
+}
+
+func appendField(payload []byte, tag uint8, value []byte) []byte {
+	payload = append(payload, tag)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(value)))
+	return append(payload, value...)
+}
+
+func parseFields(payload []byte) (map[uint8][]byte, error) {
+	fields := make(map[uint8][]byte)
+
+	for len(payload) > 0 {
+		if len(payload) < 3 {
+			return nil, errors.New("truncated field header")
+		}
+
+		tag := payload[0]
+		length := int(binary.BigEndian.Uint16(payload[1:3]))
+		if len(payload) < 3+length {
+			return nil, fmt.Errorf("truncated field: %d", tag)
+		}
+		if _, ok := fields[tag]; ok {
+			return nil, fmt.Errorf("duplicate field: %d", tag)
+		}
+
+		fields[tag] = payload[3 : 3+length]
+		payload = payload[3+length:]
+	}
+
+	return fields, nil
+}
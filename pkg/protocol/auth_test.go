@@ -0,0 +1,212 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsStates returns the states of both sides of a new tls session
+func tlsStates(t *testing.T) (client tls.ConnectionState, server tls.ConnectionState) {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, privateKey.Public(), privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	serverConn := tls.Server(s, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: privateKey}},
+	})
+	clientConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serverConn.Handshake()
+	}()
+	if err := clientConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	return clientConn.ConnectionState(), serverConn.ConnectionState()
+}
+
+func TestAuthRoundTrip(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, auth := range []Auth{
+		{Role: RoleUp, Group: "0"},
+		{Role: RoleDown, Group: "255"},
+		{Role: RoleUp, Group: "web", Multiplex: true, Framing: true},
+		{Role: RoleDown, Group: "é", PublicKey: publicKey, Instance: "host-1", Weight: 300},
+		{Role: RoleUp, Group: strings.Repeat("g", MaxGroupSize), Instance: strings.Repeat("i", MaxInstanceSize)},
+	} {
+		decoded, err := UnmarshalAuth(auth.Marshal())
+		if err != nil {
+			t.Fatalf("%+v: %v", auth, err)
+		}
+		if decoded.Role != auth.Role || decoded.Group != auth.Group || decoded.Multiplex != auth.Multiplex ||
+			!bytes.Equal(decoded.PublicKey, auth.PublicKey) || decoded.Instance != auth.Instance ||
+			decoded.Weight != auth.Weight || decoded.Framing != auth.Framing || decoded.Signature != nil {
+			t.Fatalf("expected %+v, got %+v", auth, *decoded)
+		}
+	}
+}
+
+func TestUnmarshalAuthLegacyGroup(t *testing.T) {
+	payload := appendField(nil, fieldRole, []byte{RoleUp})
+	payload = appendField(payload, fieldGroupId, []byte{7})
+
+	auth, err := UnmarshalAuth(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Group != "7" {
+		t.Fatalf("expected group 7, got %q", auth.Group)
+	}
+}
+
+func TestUnmarshalAuthMalformed(t *testing.T) {
+	valid := (&Auth{Role: RoleUp, Group: "g"}).Marshal()
+	with := func(tag uint8, value []byte) []byte {
+		return appendField(bytes.Clone(valid), tag, value)
+	}
+	signature := bytes.Repeat([]byte{1}, ed25519.SignatureSize)
+
+	for _, test := range []struct {
+		name    string
+		payload []byte
+	}{
+		{"truncated header", valid[:len(valid)-len("g")-2]},
+		{"truncated value", valid[:len(valid)-1]},
+		{"length past the end", append(bytes.Clone(valid), fieldInstance, 0xff, 0xff, 'a')},
+		{"duplicate field", with(fieldRole, []byte{RoleUp})},
+		{"missing role", appendField(nil, fieldGroup, []byte("g"))},
+		{"invalid role", appendField(appendField(nil, fieldRole, []byte{3}), fieldGroup, []byte("g"))},
+		{"oversized role", appendField(appendField(nil, fieldRole, []byte{RoleUp, 0}), fieldGroup, []byte("g"))},
+		{"missing group", appendField(nil, fieldRole, []byte{RoleUp})},
+		{"empty group", appendField(appendField(nil, fieldRole, []byte{RoleUp}), fieldGroup, nil)},
+		{"oversized group", appendField(appendField(nil, fieldRole, []byte{RoleUp}), fieldGroup, bytes.Repeat([]byte("g"), MaxGroupSize+1))},
+		{"group with control characters", appendField(appendField(nil, fieldRole, []byte{RoleUp}), fieldGroup, []byte("g\n"))},
+		{"oversized legacy group", appendField(appendField(nil, fieldRole, []byte{RoleUp}), fieldGroupId, []byte{1, 2})},
+		{"oversized multiplex", with(fieldMultiplex, []byte{1, 1})},
+		{"short public key", with(fieldPublicKey, make([]byte, ed25519.PublicKeySize-1))},
+		{"oversized instance", with(fieldInstance, bytes.Repeat([]byte("i"), MaxInstanceSize+1))},
+		{"invalid instance", with(fieldInstance, []byte{0xff})},
+		{"short weight", with(fieldWeight, []byte{1})},
+		{"oversized framing", with(fieldFraming, []byte{1, 1})},
+		{"short signature", with(fieldSignature, signature[1:])},
+		{"signature before claims", appendField(appendField(nil, fieldSignature, signature), fieldRole, []byte{RoleUp})},
+		{"field after the signature", appendField(with(fieldSignature, signature), fieldInstance, []byte("i"))},
+	} {
+		if _, err := UnmarshalAuth(test.payload); err == nil {
+			t.Fatalf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestUnmarshalAuthIgnoresUnknownFields(t *testing.T) {
+	payload := appendField((&Auth{Role: RoleUp, Group: "g"}).Marshal(), 0xfe, []byte("future"))
+	if _, err := UnmarshalAuth(payload); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientState, serverState := tlsStates(t)
+	_, otherServerState := tlsStates(t)
+	challenge := []byte("challenge")
+
+	auth := &Auth{Role: RoleUp, Group: "g", PublicKey: publicKey, Instance: "a", Weight: 2}
+	payload, err := auth.Sign(privateKey, clientState, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := UnmarshalAuth(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Verify(publicKey, serverState, challenge) {
+		t.Fatal("a valid signature has been rejected")
+	}
+	if decoded.Verify(otherPublicKey, serverState, challenge) {
+		t.Fatal("the signature has been accepted for another key")
+	}
+	if decoded.Verify(publicKey, otherServerState, challenge) {
+		t.Fatal("the signature has been accepted for another tls session")
+	}
+	if decoded.Verify(publicKey, serverState, []byte("another challenge")) {
+		t.Fatal("the signature has been accepted for another challenge")
+	}
+
+	// every claim is covered by the signature
+	signature := payload[len(payload)-3-ed25519.SignatureSize:]
+	for _, tampered := range []*Auth{
+		{Role: RoleDown, Group: "g", PublicKey: publicKey, Instance: "a", Weight: 2},
+		{Role: RoleUp, Group: "h", PublicKey: publicKey, Instance: "a", Weight: 2},
+		{Role: RoleUp, Group: "g", PublicKey: publicKey, Instance: "b", Weight: 2},
+		{Role: RoleUp, Group: "g", PublicKey: publicKey, Instance: "a", Weight: 3},
+		{Role: RoleUp, Group: "g", PublicKey: publicKey, Instance: "a", Weight: 2, Multiplex: true},
+	} {
+		decoded, err := UnmarshalAuth(append(tampered.Marshal(), signature...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Verify(publicKey, serverState, challenge) {
+			t.Fatalf("the signature has been accepted for tampered claims %+v", *tampered)
+		}
+	}
+}
+
+func TestAcceptRoundTrip(t *testing.T) {
+	for _, accept := range []Accept{{}, {Framing: true}} {
+		decoded, err := UnmarshalAccept(accept.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *decoded != accept {
+			t.Fatalf("expected %+v, got %+v", accept, *decoded)
+		}
+	}
+
+	if _, err := UnmarshalAccept(appendField(nil, acceptFieldFraming, []byte{1, 1})); err == nil {
+		t.Fatal("expected an error for an oversized framing flag")
+	}
+}
@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// after the handshake, the data of a connection which is not multiplexed is framed as:
+//
+//	type(1) | length(2) | payload(length)
+//
+// so that the end of the data and an abort are told apart,
+// the close_notify alert of tls can not be distinguished from a closed connection
+const frameHeaderSize = 1 + 2
+
+// the longest time to send the last frame when the connection is closed
+const closeTimeout = 5 * time.Second
+
+const (
+	// connection data
+	frameData uint8 = iota + 1
+	// the sender will not send any more data (half close)
+	frameFin
+	// abort the connection
+	frameReset
+)
+
+var (
+	ErrConnReset = errors.New("connection reset by peer")
+	// the connection ended without a fin frame, e.g. the peer crashed
+	ErrMissingFin = fmt.Errorf("connection closed without a fin: %w", io.ErrUnexpectedEOF)
+)
+
+// FramedConn sends the data, the half-close and the abort of a connection as frames
+type FramedConn struct {
+	net.Conn
+
+	// only a single reader is supported
+	header    [frameHeaderSize]byte
+	headerLen int
+	// unread bytes of the current data frame
+	remaining int
+	readErr   error
+
+	writeLock sync.Mutex
+	writeBuf  []byte
+	finSent   bool
+	reset     bool
+
+	// set by the first Close or Reset
+	closing atomic.Bool
+}
+
+func NewFramedConn(conn net.Conn) *FramedConn {
+	return &FramedConn{
+		Conn: conn,
+	}
+}
+
+// NetConn returns the framed connection
+func (c *FramedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *FramedConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+
+		// the header may be read in several attempts, e.g. when a deadline expires in between
+		n, err := c.Conn.Read(c.header[c.headerLen:])
+		c.headerLen += n
+		if c.headerLen < frameHeaderSize {
+			if err == nil {
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				err = ErrMissingFin
+			}
+			return 0, err
+		}
+		c.headerLen = 0
+
+		switch c.header[0] {
+		case frameData:
+			c.remaining = int(binary.BigEndian.Uint16(c.header[1:]))
+		case frameFin:
+			c.readErr = io.EOF
+		case frameReset:
+			c.readErr = ErrConnReset
+		default:
+			c.readErr = fmt.Errorf("invalid frame type: %d", c.header[0])
+		}
+	}
+
+	n, err := c.Conn.Read(b[:min(len(b), c.remaining)])
+	c.remaining -= n
+	if errors.Is(err, io.EOF) {
+		err = ErrMissingFin
+	}
+	return n, err
+}
+
+func (c *FramedConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.finSent || c.reset {
+		return 0, net.ErrClosed
+	}
+
+	written := 0
+	for written < len(b) {
+		n := min(len(b)-written, math.MaxUint16)
+
+		// the header and the payload are written at once, so that they are sent in the same tls record
+		c.writeBuf = append(c.writeBuf[:0], frameData)
+		c.writeBuf = binary.BigEndian.AppendUint16(c.writeBuf, uint16(n))
+		c.writeBuf = append(c.writeBuf, b[written:written+n]...)
+		if _, err := c.Conn.Write(c.writeBuf); err != nil {
+			return written, err
+		}
+		written += n
+	}
+
+	return written, nil
+}
+
+// writeFrameLocked writes a frame without payload, the write lock must be held
+func (c *FramedConn) writeFrameLocked(typ uint8) error {
+	_, err := c.Conn.Write([]byte{typ, 0, 0})
+	return err
+}
+
+// CloseWrite sends a fin frame to the peer,
+// the connection can still be read until the peer closes its side
+func (c *FramedConn) CloseWrite() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.finSent || c.reset {
+		return nil
+	}
+	c.finSent = true
+
+	return c.writeFrameLocked(frameFin)
+}
+
+// Reset aborts the connection, the peer will receive ErrConnReset
+func (c *FramedConn) Reset() error {
+	c.closeWithFrame(frameReset)
+	return nil
+}
+
+// Close sends a fin frame unless the connection has been half-closed or reset,
+// like a tcp connection closed gracefully
+func (c *FramedConn) Close() error {
+	c.closeWithFrame(frameFin)
+	return nil
+}
+
+// closeWithFrame sends the last frame and closes the connection in the background,
+// so that closing never waits for a backpressured peer, only the first call counts.
+// The frame is skipped while a write is in flight, which the peer reads as an abort,
+// like tls skips its close_notify alert
+func (c *FramedConn) closeWithFrame(typ uint8) {
+	if !c.closing.CompareAndSwap(false, true) {
+		return
+	}
+
+	if !c.writeLock.TryLock() {
+		c.Conn.Close()
+		return
+	}
+
+	go func() {
+		// the lock is kept until the connection is closed, later writes fail
+		defer c.writeLock.Unlock()
+
+		if !c.reset && !(c.finSent && typ == frameFin) {
+			if typ == frameReset {
+				c.reset = true
+			} else {
+				c.finSent = true
+			}
+
+			c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+			c.writeFrameLocked(typ)
+		}
+		c.Conn.Close()
+	}()
+}
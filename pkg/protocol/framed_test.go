@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func framedPipe() (*FramedConn, *FramedConn) {
+	a, b := net.Pipe()
+	return NewFramedConn(a), NewFramedConn(b)
+}
+
+func TestFramedConnHalfClose(t *testing.T) {
+	a, b := framedPipe()
+	defer a.Close()
+	defer b.Close()
+
+	// larger than a single frame
+	data := bytes.Repeat([]byte("data"), 20000)
+	errs := make(chan error, 1)
+	go func() {
+		if _, err := a.Write(data); err != nil {
+			errs <- err
+			return
+		}
+		errs <- a.CloseWrite()
+	}()
+
+	received, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("expected %d bytes, got %d", len(data), len(received))
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Write([]byte("more")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected a write after the fin to fail, got %v", err)
+	}
+
+	// the other direction is still open
+	go func() {
+		if _, err := b.Write([]byte("reply")); err != nil {
+			errs <- err
+			return
+		}
+		errs <- b.CloseWrite()
+	}()
+
+	received, err = io.ReadAll(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != "reply" {
+		t.Fatalf("expected reply, got %q", received)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFramedConnReset(t *testing.T) {
+	a, b := framedPipe()
+	defer b.Close()
+
+	if err := a.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadAll(b); !errors.Is(err, ErrConnReset) {
+		t.Fatalf("expected %v, got %v", ErrConnReset, err)
+	}
+	if _, err := a.Write([]byte("data")); err == nil {
+		t.Fatal("expected a write after the reset to fail")
+	}
+}
+
+func TestFramedConnClose(t *testing.T) {
+	a, b := framedPipe()
+	defer b.Close()
+
+	// closing gracefully sends a fin, a later reset is ignored
+	a.Close()
+	a.Reset()
+
+	if _, err := io.ReadAll(b); err != nil {
+		t.Fatalf("expected an end of file, got %v", err)
+	}
+}
+
+func TestFramedConnMissingFin(t *testing.T) {
+	a, b := framedPipe()
+	defer b.Close()
+
+	go func() {
+		a.Write([]byte("data"))
+		// the peer went away without a frame
+		a.NetConn().Close()
+	}()
+
+	received, err := io.ReadAll(b)
+	if !errors.Is(err, ErrMissingFin) {
+		t.Fatalf("expected %v, got %v", ErrMissingFin, err)
+	}
+	if string(received) != "data" {
+		t.Fatalf("expected data, got %q", received)
+	}
+}
+
+func TestFramedConnInvalidFrame(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	framed := NewFramedConn(b)
+	defer framed.Close()
+
+	go a.Write([]byte{0xff, 0, 0})
+
+	if _, err := framed.Read(make([]byte, 1)); err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("expected an invalid frame error, got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// every message exchanged during the handshake is framed as:
+//
+//	magic(2) | version(1) | type(1) | length(2) | payload(length)
+const (
+	Magic   uint16 = 0x5452 // "TR"
+	Version uint8  = 2
+
+	HeaderSize     = 2 + 1 + 1 + 2
+	MaxPayloadSize = 0xffff
+)
+
+const (
+	// sent by the relay server, the payload is a random challenge
+	MessageTypeChallenge uint8 = iota + 1
+	// sent by the client, the payload is the encoded Auth
+	MessageTypeAuth
+	// sent by the relay server when the handshake succeeded
+	MessageTypeAccept
+	// sent by either side before closing the connection,
+	// the payload is a human readable reason
+	MessageTypeReject
+	// sent by the entry-point to the reverse-proxy, the payload is the encoded Route
+	MessageTypeRoute
+)
+
+const ChallengeSize = 32
+
+var ErrInvalidMagic = errors.New("invalid magic, the peer does not speak the tcp-reverse-proxy protocol")
+
+type VersionError struct {
+	Version uint8
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %d, expected %d", e.Version, Version)
+}
+
+type RejectError struct {
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return "rejected by peer: " + e.Reason
+}
+
+type Message struct {
+	Type    uint8
+	Payload []byte
+}
+
+func EncodeMessage(msgType uint8, payload []byte) ([]byte, error) {
+	if len(payload) > MaxPayloadSize {
+		return nil, fmt.Errorf("payload too large: %d", len(payload))
+	}
+
+	buffer := make([]byte, HeaderSize+len(payload))
+	binary.BigEndian.PutUint16(buffer[0:2], Magic)
+	buffer[2] = Version
+	buffer[3] = msgType
+	binary.BigEndian.PutUint16(buffer[4:6], uint16(len(payload)))
+	copy(buffer[HeaderSize:], payload)
+
+	return buffer, nil
+}
+
+func WriteMessage(w io.Writer, msgType uint8, payload []byte) error {
+	buffer, err := EncodeMessage(msgType, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(buffer)
+	return err
+}
+
+func ReadMessage(r io.Reader) (*Message, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint16(header[0:2]) != Magic {
+		return nil, ErrInvalidMagic
+	}
+	if header[2] != Version {
+		return nil, &VersionError{Version: header[2]}
+	}
+
+	msg := &Message{
+		Type:    header[3],
+		Payload: make([]byte, binary.BigEndian.Uint16(header[4:6])),
+	}
+	if _, err := io.ReadFull(r, msg.Payload); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// ExpectMessage reads a message and makes sure it has the expected type,
+// a reject message is converted to a RejectError
+func ExpectMessage(r io.Reader, msgType uint8) (*Message, error) {
+	msg, err := ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Type == MessageTypeReject {
+		return nil, &RejectError{Reason: string(msg.Payload)}
+	}
+	if msg.Type != msgType {
+		return nil, fmt.Errorf("unexpected message type: %d, expected %d", msg.Type, msgType)
+	}
+
+	return msg, nil
+}
+
+// Reject informs the peer why the connection is going to be closed,
+// the error is ignored because the connection is closed anyway
+func Reject(w io.Writer, reason string) {
+	if len(reason) > MaxPayloadSize {
+		reason = reason[:MaxPayloadSize]
+	}
+	WriteMessage(w, MessageTypeReject, []byte(reason))
+}
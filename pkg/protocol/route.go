@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	AddressTypeIPv4   uint8 = 0x01
+	AddressTypeDomain uint8 = 0x03
+	AddressTypeIPv6   uint8 = 0x04
+)
+
+// the route fields, encoded like the auth fields
+const (
+	fieldDestination uint8 = iota + 1
+	fieldNetwork
+	fieldSource
+	fieldListener
+)
+
+// the network of the route, tcp is assumed when it is missing
+const (
+	NetworkTCP uint8 = 0x01
+	// datagrams are framed as length(2) | payload inside the connection
+	NetworkUDP uint8 = 0x02
+)
+
+type Address struct {
+	Host string
+	Port uint16
+}
+
+func (a Address) String() string {
+	return net.JoinHostPort(a.Host, fmt.Sprint(a.Port))
+}
+
+// the address is encoded as:
+//
+//	type(1) | ipv4(4) or ipv6(16) or length(1)+domain(length) | port(2)
+func (a Address) Marshal() ([]byte, error) {
+	var b []byte
+
+	ip := net.ParseIP(a.Host)
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, AddressTypeIPv4)
+		b = append(b, ip4...)
+	} else if ip != nil {
+		b = append(b, AddressTypeIPv6)
+		b = append(b, ip.To16()...)
+	} else {
+		if len(a.Host) == 0 || len(a.Host) > 255 {
+			return nil, fmt.Errorf("invalid domain: %s", a.Host)
+		}
+		b = append(b, AddressTypeDomain, byte(len(a.Host)))
+		b = append(b, a.Host...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, a.Port), nil
+}
+
+func UnmarshalAddress(b []byte) (Address, error) {
+	if len(b) < 1 {
+		return Address{}, errors.New("empty address")
+	}
+
+	var host string
+	var rest []byte
+	switch b[0] {
+	case AddressTypeIPv4:
+		if len(b) != 1+4+2 {
+			return Address{}, errors.New("malformed ipv4 address")
+		}
+		host = net.IP(b[1:5]).String()
+		rest = b[5:]
+	case AddressTypeIPv6:
+		if len(b) != 1+16+2 {
+			return Address{}, errors.New("malformed ipv6 address")
+		}
+		host = net.IP(b[1:17]).String()
+		rest = b[17:]
+	case AddressTypeDomain:
+		if len(b) < 2 || b[1] == 0 || len(b) != 2+int(b[1])+2 {
+			return Address{}, errors.New("malformed domain address")
+		}
+		host = string(b[2 : 2+b[1]])
+		rest = b[2+b[1]:]
+	default:
+		return Address{}, fmt.Errorf("invalid address type: %d", b[0])
+	}
+
+	return Address{
+		Host: host,
+		Port: binary.BigEndian.Uint16(rest),
+	}, nil
+}
+
+// Route is sent by the entry-point through the relay server
+// as the first message of every proxied connection
+type Route struct {
+	Network     uint8
+	Destination Address
+
+	// the address of the client and the address it connected to on the entry-point,
+	// they are empty when the entry-point does not send them
+	Source   Address
+	Listener Address
+}
+
+// String returns the network and the destination of the route
+func (r *Route) String() string {
+	network := "tcp"
+	if r.Network == NetworkUDP {
+		network = "udp"
+	}
+	return network + "/" + r.Destination.String()
+}
+
+func (r *Route) Marshal() ([]byte, error) {
+	destination, err := r.Destination.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := appendField(nil, fieldDestination, destination)
+	if r.Network != NetworkTCP {
+		payload = appendField(payload, fieldNetwork, []byte{r.Network})
+	}
+	// older reverse-proxies ignore the fields they do not know
+	if r.Source.Host != "" {
+		source, err := r.Source.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		payload = appendField(payload, fieldSource, source)
+	}
+	if r.Listener.Host != "" {
+		listener, err := r.Listener.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		payload = appendField(payload, fieldListener, listener)
+	}
+	return payload, nil
+}
+
+func UnmarshalRoute(payload []byte) (*Route, error) {
+	fields, err := parseFields(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	destination, ok := fields[fieldDestination]
+	if !ok {
+		return nil, errors.New("missing destination")
+	}
+
+	address, err := UnmarshalAddress(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	network := NetworkTCP
+	if value, ok := fields[fieldNetwork]; ok {
+		if len(value) != 1 || (value[0] != NetworkTCP && value[0] != NetworkUDP) {
+			return nil, errors.New("invalid network")
+		}
+		network = value[0]
+	}
+
+	route := &Route{
+		Network:     network,
+		Destination: address,
+	}
+	if value, ok := fields[fieldSource]; ok {
+		route.Source, err = UnmarshalAddress(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source: %w", err)
+		}
+	}
+	if value, ok := fields[fieldListener]; ok {
+		route.Listener, err = UnmarshalAddress(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listener: %w", err)
+		}
+	}
+
+	return route, nil
+}
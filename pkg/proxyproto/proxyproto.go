@@ -0,0 +1,314 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// the signature starting every v2 header
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// the header is sent on behalf of the client
+	commandProxy uint8 = 0x21
+	// the header carries no address, e.g. the client is unknown
+	commandLocal uint8 = 0x20
+
+	familyUnspec uint8 = 0x00
+	familyTCP4   uint8 = 0x11
+	familyUDP4   uint8 = 0x12
+	familyTCP6   uint8 = 0x21
+	familyUDP6   uint8 = 0x22
+	// unix sockets leave the client unknown
+	familyUnixStream uint8 = 0x31
+	familyUnixDgram  uint8 = 0x32
+)
+
+// Header describes the connection of a client with the PROXY protocol
+type Header struct {
+	// "tcp" or "udp"
+	Network string
+
+	// the address of the client and the address it connected to,
+	// the client is unknown if either of them is invalid
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+}
+
+// addresses returns the addresses of the header in the same family, ok is false if they are unknown
+func (h *Header) addresses() (source netip.AddrPort, destination netip.AddrPort, ok bool) {
+	if !h.Source.IsValid() || !h.Destination.IsValid() {
+		return
+	}
+
+	source = netip.AddrPortFrom(h.Source.Addr().Unmap(), h.Source.Port())
+	destination = netip.AddrPortFrom(h.Destination.Addr().Unmap(), h.Destination.Port())
+	if source.Addr().Is4() != destination.Addr().Is4() {
+		// an ipv4 address is written as an ipv4-mapped ipv6 address next to an ipv6 address
+		source = netip.AddrPortFrom(netip.AddrFrom16(source.Addr().As16()), source.Port())
+		destination = netip.AddrPortFrom(netip.AddrFrom16(destination.Addr().As16()), destination.Port())
+	}
+	return source, destination, true
+}
+
+// MarshalV1 encodes the header in the human readable format, which only supports tcp
+func (h *Header) MarshalV1() ([]byte, error) {
+	if h.Network != "tcp" {
+		return nil, fmt.Errorf("unsupported network of the v1 header: %s", h.Network)
+	}
+
+	source, destination, ok := h.addresses()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+
+	family := "TCP4"
+	if !source.Addr().Is4() {
+		family = "TCP6"
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, source.Addr(), destination.Addr(), source.Port(), destination.Port()), nil
+}
+
+// MarshalV2 encodes the header in the binary format
+func (h *Header) MarshalV2() ([]byte, error) {
+	if h.Network != "tcp" && h.Network != "udp" {
+		return nil, fmt.Errorf("unsupported network of the v2 header: %s", h.Network)
+	}
+
+	b := append([]byte{}, signature...)
+
+	source, destination, ok := h.addresses()
+	if !ok {
+		b = append(b, commandLocal, familyUnspec)
+		return binary.BigEndian.AppendUint16(b, 0), nil
+	}
+
+	var family uint8
+	var addresses []byte
+	if source.Addr().Is4() {
+		family = familyTCP4
+		if h.Network == "udp" {
+			family = familyUDP4
+		}
+		src, dst := source.Addr().As4(), destination.Addr().As4()
+		addresses = append(append(addresses, src[:]...), dst[:]...)
+	} else {
+		family = familyTCP6
+		if h.Network == "udp" {
+			family = familyUDP6
+		}
+		src, dst := source.Addr().As16(), destination.Addr().As16()
+		addresses = append(append(addresses, src[:]...), dst[:]...)
+	}
+	addresses = binary.BigEndian.AppendUint16(addresses, source.Port())
+	addresses = binary.BigEndian.AppendUint16(addresses, destination.Port())
+
+	b = append(b, commandProxy, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addresses)))
+	return append(b, addresses...), nil
+}
+
+// Marshal encodes the header in the given version
+func (h *Header) Marshal(version int) ([]byte, error) {
+	switch version {
+	case 1:
+		return h.MarshalV1()
+	case 2:
+		return h.MarshalV2()
+	default:
+		return nil, fmt.Errorf("invalid proxy protocol version: %d", version)
+	}
+}
+
+// the longest v1 header, including the trailing crlf
+const maxV1Length = 107
+
+var ErrMissingHeader = errors.New("missing proxy protocol header")
+
+// ReadHeader reads a v1 or a v2 header,
+// the addresses of the header are invalid if the client is unknown
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	prefix, err := r.Peek(len(signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(prefix, signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return nil, ErrMissingHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+		if len(line) >= maxV1Length {
+			return nil, errors.New("v1 header too long")
+		}
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Network: "tcp"}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header: %q", line)
+	}
+
+	source, err := parseV1Address(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	destination, err := parseV1Address(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Header{
+		Network:     "tcp",
+		Source:      source,
+		Destination: destination,
+	}, nil
+}
+
+func parseV1Address(ip string, port string, is4 bool) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != is4 || addr.Zone() != "" {
+		return netip.AddrPort{}, fmt.Errorf("invalid address of v1 header: %s", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return netip.AddrPort{}, fmt.Errorf("invalid port of v1 header: %s", port)
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, len(signature)+4)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	command := fixed[12]
+	family := fixed[13]
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if command&0xf0 != 0x20 {
+		return nil, fmt.Errorf("unsupported version of v2 header: %#x", command)
+	}
+
+	header := &Header{
+		Network: "tcp",
+	}
+	if family == familyUDP4 || family == familyUDP6 {
+		header.Network = "udp"
+	}
+
+	switch command {
+	case commandLocal:
+		// the connection is opened by the proxy itself, e.g. a health check
+		return header, nil
+	case commandProxy:
+	default:
+		return nil, fmt.Errorf("unsupported command of v2 header: %#x", command)
+	}
+
+	// the tlvs following the addresses are ignored
+	switch family {
+	case familyTCP4, familyUDP4:
+		if len(payload) < 12 {
+			return nil, errors.New("truncated v2 header")
+		}
+		header.Source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(payload[0:4])), binary.BigEndian.Uint16(payload[8:10]))
+		header.Destination = netip.AddrPortFrom(netip.AddrFrom4([4]byte(payload[4:8])), binary.BigEndian.Uint16(payload[10:12]))
+	case familyTCP6, familyUDP6:
+		if len(payload) < 36 {
+			return nil, errors.New("truncated v2 header")
+		}
+		header.Source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(payload[0:16])), binary.BigEndian.Uint16(payload[32:34]))
+		header.Destination = netip.AddrPortFrom(netip.AddrFrom16([16]byte(payload[16:32])), binary.BigEndian.Uint16(payload[34:36]))
+	case familyUnspec, familyUnixStream, familyUnixDgram:
+	default:
+		return nil, fmt.Errorf("unsupported family of v2 header: %#x", family)
+	}
+
+	return header, nil
+}
+
+// Conn is a connection received through a proxy, its remote address is the address of the client
+type Conn struct {
+	net.Conn
+
+	reader *bufio.Reader
+	header *Header
+}
+
+// NewConn reads the header sent by the proxy at the start of the connection
+func NewConn(conn net.Conn) (*Conn, error) {
+	reader := bufio.NewReader(conn)
+	header, err := ReadHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:   conn,
+		reader: reader,
+		header: header,
+	}, nil
+}
+
+// Header returns the header sent by the proxy
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+// NetConn returns the connection to the proxy
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	// the data read along with the header is consumed first
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the address of the client, or the address of the proxy if the client is unknown
+func (c *Conn) RemoteAddr() net.Addr {
+	if !c.header.Source.IsValid() {
+		return c.Conn.RemoteAddr()
+	}
+	return net.TCPAddrFromAddrPort(c.header.Source)
+}
+
+func (c *Conn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
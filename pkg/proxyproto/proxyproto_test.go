@@ -0,0 +1,201 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func v2Header(command uint8, family uint8, payload []byte) []byte {
+	b := append([]byte{}, signature...)
+	b = append(b, command, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func readString(s string) (*Header, error) {
+	return ReadHeader(bufio.NewReader(strings.NewReader(s)))
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	v4 := netip.MustParseAddrPort("192.168.0.1:56324")
+	v4Destination := netip.MustParseAddrPort("10.0.0.1:443")
+	v6 := netip.MustParseAddrPort("[2001:db8::1]:56324")
+	v6Destination := netip.MustParseAddrPort("[fd00::1]:443")
+	mapped := netip.MustParseAddrPort("[::ffff:192.168.0.1]:56324")
+
+	for _, test := range []struct {
+		header   Header
+		versions []int
+	}{
+		{Header{Network: "tcp", Source: v4, Destination: v4Destination}, []int{1, 2}},
+		{Header{Network: "tcp", Source: v6, Destination: v6Destination}, []int{1, 2}},
+		{Header{Network: "tcp", Source: mapped, Destination: v4Destination}, []int{1, 2}},
+		// an ipv4 address next to an ipv6 address is sent as an ipv4-mapped address
+		{Header{Network: "tcp", Source: v4, Destination: v6Destination}, []int{1, 2}},
+		{Header{Network: "udp", Source: v4, Destination: v4Destination}, []int{2}},
+		{Header{Network: "udp", Source: v6, Destination: v6Destination}, []int{2}},
+		// the client is unknown
+		{Header{Network: "tcp"}, []int{1, 2}},
+		{Header{Network: "tcp", Source: v4}, []int{1, 2}},
+		{Header{Network: "udp"}, []int{2}},
+	} {
+		for _, version := range test.versions {
+			b, err := test.header.Marshal(version)
+			if err != nil {
+				t.Fatalf("%+v v%d: %v", test.header, version, err)
+			}
+
+			header, err := ReadHeader(bufio.NewReader(bytes.NewReader(b)))
+			if err != nil {
+				t.Fatalf("%+v v%d: %v", test.header, version, err)
+			}
+
+			source, destination, known := test.header.addresses()
+			if known {
+				source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+				destination = netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port())
+			}
+			decodedSource, decodedDestination, _ := header.addresses()
+			if known && header.Network != test.header.Network {
+				t.Fatalf("%+v v%d: expected network %s, got %s", test.header, version, test.header.Network, header.Network)
+			}
+			if netip.AddrPortFrom(decodedSource.Addr().Unmap(), decodedSource.Port()) != source ||
+				netip.AddrPortFrom(decodedDestination.Addr().Unmap(), decodedDestination.Port()) != destination {
+				t.Fatalf("%+v v%d: got %+v", test.header, version, *header)
+			}
+		}
+	}
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	header := Header{Network: "udp", Source: netip.MustParseAddrPort("10.0.0.1:1"), Destination: netip.MustParseAddrPort("10.0.0.2:2")}
+	if _, err := header.MarshalV1(); err == nil {
+		t.Fatal("expected an error for udp in a v1 header")
+	}
+	if _, err := header.Marshal(3); err == nil {
+		t.Fatal("expected an error for version 3")
+	}
+	header.Network = "unix"
+	if _, err := header.MarshalV2(); err == nil {
+		t.Fatal("expected an error for an unknown network")
+	}
+}
+
+func TestReadV1(t *testing.T) {
+	for _, test := range []struct {
+		line        string
+		source      string
+		destination string
+	}{
+		{"PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n", "192.168.0.1:56324", "10.0.0.1:443"},
+		{"PROXY TCP6 2001:db8::1 ::1 0 65535\r\n", "[2001:db8::1]:0", "[::1]:65535"},
+		{"PROXY UNKNOWN\r\n", "", ""},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", "", ""},
+	} {
+		header, err := readString(test.line)
+		if err != nil {
+			t.Fatalf("%q: %v", test.line, err)
+		}
+		if header.Source.IsValid() != (test.source != "") {
+			t.Fatalf("%q: got %+v", test.line, *header)
+		}
+		if test.source != "" && (header.Source != netip.MustParseAddrPort(test.source) || header.Destination != netip.MustParseAddrPort(test.destination)) {
+			t.Fatalf("%q: got %+v", test.line, *header)
+		}
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	addresses4 := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb}
+
+	for _, test := range []struct {
+		name   string
+		header string
+	}{
+		{"no header", "GET / HTTP/1.1\r\n\r\n"},
+		{"bad signature", string(append([]byte("\r\n\r\n\x00\r\nQUIX\n"), v2Header(commandProxy, familyTCP4, addresses4)[12:]...))},
+		{"short signature", "\r\n\r\n\x00\r\n"},
+		{"length overflow", string(append(v2Header(commandProxy, familyTCP4, addresses4)[:14], 0xff, 0xff))},
+		{"length past the end", string(v2Header(commandProxy, familyTCP4, addresses4)[:20])},
+		{"truncated v4 addresses", string(v2Header(commandProxy, familyTCP4, addresses4[:11]))},
+		{"truncated v6 addresses", string(v2Header(commandProxy, familyTCP6, make([]byte, 35)))},
+		{"unknown family", string(v2Header(commandProxy, 0x41, addresses4))},
+		{"unknown transport", string(v2Header(commandProxy, 0x13, addresses4))},
+		{"unknown version", string(v2Header(0x11, familyTCP4, addresses4))},
+		{"unknown command", string(v2Header(0x22, familyTCP4, addresses4))},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", maxV1Length) + "\r\n"},
+		{"v1 without crlf", "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\n"},
+		{"v1 unknown family", "PROXY TCP5 192.168.0.1 10.0.0.1 56324 443\r\n"},
+		{"v1 udp", "PROXY UDP4 192.168.0.1 10.0.0.1 56324 443\r\n"},
+		{"v1 missing port", "PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n"},
+		{"v1 extra field", "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443 1\r\n"},
+		{"v1 ipv6 as ipv4", "PROXY TCP4 ::1 ::1 56324 443\r\n"},
+		{"v1 ipv4 as ipv6", "PROXY TCP6 192.168.0.1 10.0.0.1 56324 443\r\n"},
+		{"v1 zone", "PROXY TCP6 fe80::1%eth0 ::1 56324 443\r\n"},
+		{"v1 port overflow", "PROXY TCP4 192.168.0.1 10.0.0.1 65536 443\r\n"},
+		{"v1 leading zero", "PROXY TCP4 192.168.0.1 10.0.0.1 056324 443\r\n"},
+		{"v1 double space", "PROXY TCP4  192.168.0.1 10.0.0.1 56324 443\r\n"},
+	} {
+		if header, err := readString(test.header); err == nil {
+			t.Fatalf("%s: expected an error, got %+v", test.name, *header)
+		}
+	}
+
+	if _, err := readString("GET / HTTP/1.1\r\n\r\n"); !errors.Is(err, ErrMissingHeader) {
+		t.Fatalf("expected %v, got %v", ErrMissingHeader, err)
+	}
+}
+
+func TestReadV2UnknownClient(t *testing.T) {
+	for _, header := range [][]byte{
+		v2Header(commandLocal, familyUnspec, nil),
+		// the addresses of a local command are ignored
+		v2Header(commandLocal, familyTCP4, []byte{1, 2, 3}),
+		v2Header(commandProxy, familyUnspec, nil),
+		v2Header(commandProxy, familyUnixStream, make([]byte, 216)),
+	} {
+		decoded, err := ReadHeader(bufio.NewReader(bytes.NewReader(header)))
+		if err != nil {
+			t.Fatalf("%x: %v", header, err)
+		}
+		if decoded.Source.IsValid() || decoded.Destination.IsValid() {
+			t.Fatalf("%x: expected an unknown client, got %+v", header, *decoded)
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	// the tlvs after the addresses are skipped
+	addresses := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb, 0x04, 0x00, 0x01, 0x00}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		a.Write(append(v2Header(commandProxy, familyTCP4, addresses), "data"...))
+		a.Close()
+	}()
+
+	conn, err := NewConn(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if addr := conn.RemoteAddr().String(); addr != "192.168.0.1:56324" {
+		t.Fatalf("expected 192.168.0.1:56324, got %s", addr)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Fatalf("expected data, got %q", data)
+	}
+}
@@ -0,0 +1,238 @@
+package relay_server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samlior/tcp-reverse-proxy/pkg/protocol"
+)
+
+type AuthorizedKey struct {
+	Name      string
+	PublicKey ed25519.PublicKey
+
+	// allowed roles, nil means every role is allowed
+	Roles map[uint8]bool
+	// allowed groups, nil means every group is allowed
+	Groups map[string]bool
+
+	// the key must be rejected even during a rotation window
+	Revoked bool
+}
+
+func (k *AuthorizedKey) Allows(role uint8, group string) error {
+	if k.Roles != nil && !k.Roles[role] {
+		return fmt.Errorf("role not allowed for key %s", k.Name)
+	}
+	if k.Groups != nil && !k.Groups[group] {
+		return fmt.Errorf("group %s not allowed for key %s", group, k.Name)
+	}
+	return nil
+}
+
+// a key which has been removed from the authorized keys,
+// it is still accepted until the rotation window expires
+type retiringKey struct {
+	key       *AuthorizedKey
+	expiresAt time.Time
+}
+
+type Keyring struct {
+	lock     sync.RWMutex
+	keys     map[string]*AuthorizedKey
+	retiring map[string]retiringKey
+	revoked  map[string]bool
+}
+
+func NewKeyring(keys []*AuthorizedKey) (*Keyring, error) {
+	kr := &Keyring{
+		keys:     make(map[string]*AuthorizedKey),
+		retiring: make(map[string]retiringKey),
+		revoked:  make(map[string]bool),
+	}
+
+	err := kr.Update(keys, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return kr, nil
+}
+
+// Update replaces the authorized keys,
+// keys which disappeared are still accepted during the rotation window
+// unless they are explicitly revoked
+func (kr *Keyring) Update(keys []*AuthorizedKey, rotationWindow time.Duration) error {
+	active := make(map[string]*AuthorizedKey)
+	revoked := make(map[string]bool)
+
+	names := make(map[string]bool)
+	for _, key := range keys {
+		if key.Revoked {
+			revoked[string(key.PublicKey)] = true
+			continue
+		}
+		if names[key.Name] {
+			return fmt.Errorf("duplicate key name: %s", key.Name)
+		}
+		if _, ok := active[string(key.PublicKey)]; ok {
+			return fmt.Errorf("duplicate public key: %s", key.Name)
+		}
+		names[key.Name] = true
+		active[string(key.PublicKey)] = key
+	}
+
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+
+	now := time.Now()
+	retiring := make(map[string]retiringKey)
+	for publicKey, r := range kr.retiring {
+		if active[publicKey] == nil && !revoked[publicKey] && now.Before(r.expiresAt) {
+			retiring[publicKey] = r
+		}
+	}
+	if rotationWindow > 0 {
+		for publicKey, key := range kr.keys {
+			if active[publicKey] == nil && !revoked[publicKey] {
+				retiring[publicKey] = retiringKey{
+					key:       key,
+					expiresAt: now.Add(rotationWindow),
+				}
+			}
+		}
+	}
+
+	kr.keys = active
+	kr.retiring = retiring
+	kr.revoked = revoked
+
+	return nil
+}
+
+// Lookup finds the key by its public key,
+// clients which do not send their public key can only use a keyring with a single key
+func (kr *Keyring) Lookup(publicKey []byte) *AuthorizedKey {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+
+	if publicKey == nil && len(kr.keys) == 1 && len(kr.retiring) == 0 {
+		for _, key := range kr.keys {
+			return key
+		}
+	}
+
+	if key, ok := kr.keys[string(publicKey)]; ok {
+		return key
+	}
+	if r, ok := kr.retiring[string(publicKey)]; ok && time.Now().Before(r.expiresAt) {
+		return r.key
+	}
+	return nil
+}
+
+// Recheck returns why a connection authenticated by the key for the role and the group should be terminated,
+// which is the case once the key is revoked, its rotation window expired,
+// or the role or the group is no longer allowed by the reloaded key, it returns nil otherwise
+func (kr *Keyring) Recheck(key *AuthorizedKey, role uint8, group string) error {
+	current := kr.Lookup(key.PublicKey)
+	if current == nil {
+		return fmt.Errorf("key %s revoked", key.Name)
+	}
+	return current.Allows(role, group)
+}
+
+// ParseAuthorizedKeys parses one key per line:
+//
+//	[@revoked] name base64-public-key [roles=entry-point,reverse-proxy] [groups=0,team-a]
+//
+// empty lines and lines starting with # are ignored
+func ParseAuthorizedKeys(data []byte) ([]*AuthorizedKey, error) {
+	var keys []*AuthorizedKey
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		revoked := fields[0] == "@revoked"
+		if revoked {
+			fields = fields[1:]
+		}
+
+		key, err := parseAuthorizedKey(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		key.Revoked = revoked
+		keys = append(keys, key)
+	}
+
+	return keys, scanner.Err()
+}
+
+func parseAuthorizedKey(fields []string) (*AuthorizedKey, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected name and public key")
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key for %s", fields[0])
+	}
+
+	key := &AuthorizedKey{
+		Name:      fields[0],
+		PublicKey: publicKey,
+	}
+
+	for _, option := range fields[2:] {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "roles":
+			key.Roles = make(map[uint8]bool)
+			for _, role := range strings.Split(value, ",") {
+				switch role {
+				case "reverse-proxy":
+					key.Roles[protocol.RoleUp] = true
+				case "entry-point":
+					key.Roles[protocol.RoleDown] = true
+				default:
+					return nil, fmt.Errorf("invalid role: %s", role)
+				}
+			}
+		case "groups":
+			key.Groups = make(map[string]bool)
+			for _, group := range strings.Split(value, ",") {
+				err := protocol.ValidateGroup(group)
+				if err != nil {
+					return nil, fmt.Errorf("invalid group %q: %w", group, err)
+				}
+				key.Groups[group] = true
+			}
+		default:
+			return nil, fmt.Errorf("unknown option: %s", option)
+		}
+	}
+
+	return key, nil
+}
+
+func LoadAuthorizedKeys(path string) ([]*AuthorizedKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseAuthorizedKeys(data)
+}
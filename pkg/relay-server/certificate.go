@@ -0,0 +1,92 @@
+package relay_server
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/samlior/tcp-reverse-proxy/pkg/protocol"
+)
+
+const (
+	// only the ed25519 challenge is accepted
+	AuthModeEd25519 = "ed25519"
+	// only client certificates are accepted
+	AuthModeMTLS = "mtls"
+	// either of them is accepted
+	AuthModeAny = "any"
+)
+
+// the claims of a client certificate are carried by its SAN URIs:
+//
+//	trp:role:entry-point
+//	trp:role:reverse-proxy
+//	trp:group:7
+//	trp:group:team-a
+//	trp:group:*
+//
+// group names are percent-encoded
+const uriScheme = "trp"
+
+// CertificateIdentity converts the claims of a verified client certificate
+// into an authorized key without public key, named after the common name
+func CertificateIdentity(cert *x509.Certificate) (*AuthorizedKey, error) {
+	name := cert.Subject.CommonName
+	if name == "" {
+		name = "serial-" + cert.SerialNumber.String()
+	}
+
+	key := &AuthorizedKey{
+		Name:   name,
+		Roles:  make(map[uint8]bool),
+		Groups: make(map[string]bool),
+	}
+
+	anyGroup := false
+	for _, uri := range cert.URIs {
+		if uri.Scheme != uriScheme {
+			continue
+		}
+
+		claim, value, _ := strings.Cut(uri.Opaque, ":")
+		switch claim {
+		case "role":
+			switch value {
+			case "reverse-proxy":
+				key.Roles[protocol.RoleUp] = true
+			case "entry-point":
+				key.Roles[protocol.RoleDown] = true
+			default:
+				return nil, fmt.Errorf("invalid role in certificate %s: %s", name, value)
+			}
+		case "group":
+			if value == "*" {
+				anyGroup = true
+				continue
+			}
+			group, err := url.PathUnescape(value)
+			if err == nil {
+				err = protocol.ValidateGroup(group)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid group in certificate %s: %s", name, value)
+			}
+			key.Groups[group] = true
+		}
+	}
+
+	// unlike authorized keys, certificates are issued by a pki which may serve other purposes,
+	// so nothing is allowed unless it is claimed explicitly
+	if len(key.Roles) == 0 {
+		return nil, errors.New("no role claimed by certificate " + name)
+	}
+	if anyGroup {
+		key.Groups = nil
+	} else if len(key.Groups) == 0 {
+		return nil, errors.New("no group claimed by certificate " + name)
+	}
+
+	return key, nil
+}
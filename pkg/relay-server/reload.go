@@ -0,0 +1,166 @@
+package relay_server
+
+import (
+	"crypto/sha256"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+)
+
+var keysLogger = logging.New("keys")
+
+// interval to expire retiring keys and terminate revoked clients
+const enforceInterval = time.Second * 5
+
+func (s *RelayServer) addClient(conn net.Conn, c *client) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	s.clients[conn] = c
+}
+
+func (s *RelayServer) removeClient(conn net.Conn) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	delete(s.clients, conn)
+}
+
+// terminateRevoked closes every client connection authenticated by a revoked key,
+// or whose role or group is no longer allowed by its key,
+// closing a multiplexed session closes all of its streams as well
+func (s *RelayServer) terminateRevoked() {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	for conn, c := range s.clients {
+		// certificates are revoked by their pki
+		if c.key.PublicKey == nil {
+			continue
+		}
+
+		err := s.keyring.Recheck(c.key, c.role, c.group)
+		if err != nil {
+			keysLogger.Info("terminating client no longer authorized",
+				slog.String(logging.KeyRemoteAddr, conn.RemoteAddr().String()),
+				slog.String("identity", c.key.Name),
+				slog.String(logging.KeyGroup, c.group),
+				logging.Err(err),
+			)
+			conn.Close()
+			delete(s.clients, conn)
+		}
+	}
+}
+
+// WatchKeys reloads the authorized keys whenever the file at path changes or SIGHUP is received,
+// keys which disappeared are still accepted during the rotation window
+func (s *RelayServer) WatchKeys(path string, load func() ([]*AuthorizedKey, error), rotationWindow time.Duration, terminateRevoked bool) {
+	// the resolved file and the content of the loaded keys, so that a change of either is noticed
+	loaded, _ := fingerprintKeys(path)
+
+	reload := func() {
+		loaded, _ = fingerprintKeys(path)
+
+		keys, err := load()
+		if err != nil {
+			keysLogger.Error("failed to reload authorized keys", logging.Err(err))
+			return
+		}
+
+		err = s.keyring.Update(keys, rotationWindow)
+		if err != nil {
+			keysLogger.Error("failed to reload authorized keys", logging.Err(err))
+			return
+		}
+
+		keysLogger.Info("reloaded authorized keys", slog.Int("keys", len(keys)))
+
+		if terminateRevoked {
+			s.terminateRevoked()
+		}
+	}
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+
+	// watch the directory instead of the file, editors and secret managers usually replace the file,
+	// e.g. a mounted ConfigMap swaps a symlink to a new directory, so the directory of the target is watched as well
+	var events chan fsnotify.Event
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		err = watcher.Add(filepath.Dir(path))
+	}
+	watchTarget := func() {
+		if watcher != nil && loaded.target != "" && filepath.Dir(loaded.target) != filepath.Dir(path) {
+			watcher.Add(filepath.Dir(loaded.target))
+		}
+	}
+	watchTarget()
+	if err != nil {
+		keysLogger.Warn("failed to watch authorized keys, only SIGHUP reloads them", logging.Err(err))
+	} else {
+		events = watcher.Events
+	}
+
+	ticker := time.NewTicker(enforceInterval)
+	defer ticker.Stop()
+
+	// debounce bursts of file events
+	var debounce <-chan time.Time
+
+	for {
+		select {
+		case <-s.Closed:
+			return
+		case <-hupCh:
+			keysLogger.Info("received SIGHUP, reloading authorized keys...")
+			reload()
+			watchTarget()
+		case event := <-events:
+			// the name of the event may be the file, a symlink or a directory it resolves through
+			if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) || event.Has(fsnotify.Rename) || event.Has(fsnotify.Remove) {
+				debounce = time.After(time.Millisecond * 100)
+			}
+		case <-debounce:
+			debounce = nil
+			// the other files of the directory are ignored
+			current, err := fingerprintKeys(path)
+			if err == nil && current != loaded {
+				reload()
+				watchTarget()
+			}
+		case <-ticker.C:
+			if terminateRevoked {
+				s.terminateRevoked()
+			}
+		}
+	}
+}
+
+// keysFingerprint identifies the file the keys are loaded from and its content
+type keysFingerprint struct {
+	target string
+	sum    [sha256.Size]byte
+}
+
+func fingerprintKeys(path string) (keysFingerprint, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return keysFingerprint{}, err
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		return keysFingerprint{}, err
+	}
+	return keysFingerprint{target, sha256.Sum256(data)}, nil
+}
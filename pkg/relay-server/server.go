@@ -1,79 +1,273 @@
 package relay_server
 
 import (
-	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/samlior/tcp-reverse-proxy/pkg/common"
 	"github.com/samlior/tcp-reverse-proxy/pkg/constant"
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+	"github.com/samlior/tcp-reverse-proxy/pkg/metrics"
+	"github.com/samlior/tcp-reverse-proxy/pkg/mux"
+	"github.com/samlior/tcp-reverse-proxy/pkg/protocol"
 )
 
+var logger = logging.New("relay-server")
+
 type RelayServer struct {
 	*common.CommonServer
 
-	authPublicKeyBytes []byte
+	keyring  *Keyring
+	authMode string
+
+	// authenticated client connections and their claims
+	clientsLock sync.Mutex
+	clients     map[net.Conn]*client
 }
 
-func NewRelayServer(authPublicKeyBytes []byte) *RelayServer {
-	return &RelayServer{
-		authPublicKeyBytes: authPublicKeyBytes,
-		CommonServer:       common.NewCommonServer(),
+// client is an authenticated client connection,
+// along with the role and the group it claimed so that they can be checked again after a reload
+type client struct {
+	key   *AuthorizedKey
+	role  uint8
+	group string
+}
+
+func NewRelayServer(keyring *Keyring, authMode string, balancer common.Balancer) *RelayServer {
+	s := &RelayServer{
+		keyring:      keyring,
+		authMode:     authMode,
+		clients:      make(map[net.Conn]*client),
+		CommonServer: common.NewCommonServer(),
 	}
+	s.Balancer = balancer
+	// the entry-points connect the clients
+	s.ClientConnType = constant.ConnTypeDown
+	return s
 }
 
-func (s *RelayServer) HandleConnection(conn net.Conn) {
-	s.CommonServer.HandleConnection(conn, constant.ConnTypeUnknown, func(conn *common.Conn) error {
-		randomBytes := make([]byte, 32)
-		_, err := rand.Read(randomBytes)
-		if err != nil {
-			return err
+func (s *RelayServer) handshake(conn net.Conn) (*protocol.Auth, *AuthorizedKey, error) {
+	conn.SetDeadline(time.Now().Add(constant.HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// failures are counted by reason in the metrics
+	fail := func(reason string, err error) (*protocol.Auth, *AuthorizedKey, error) {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			reason = "timeout"
 		}
+		metrics.HandshakeFailures.WithLabelValues(reason).Inc()
+		return nil, nil, err
+	}
 
-		_, err = conn.Conn.Write(randomBytes)
-		if err != nil {
-			return err
+	// the signature is bound to the tls session and the client certificate is verified by it,
+	// so the tls handshake must be completed first
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return fail("tls", errors.New("not a tls connection"))
+	}
+	err := tlsConn.Handshake()
+	if err != nil {
+		return fail("tls", err)
+	}
+
+	challenge := make([]byte, protocol.ChallengeSize)
+	_, err = rand.Read(challenge)
+	if err != nil {
+		return fail("internal", err)
+	}
+
+	err = protocol.WriteMessage(conn, protocol.MessageTypeChallenge, challenge)
+	if err != nil {
+		return fail("io", err)
+	}
+
+	// wait for challenge answer
+	msg, err := protocol.ReadMessage(conn)
+	if err != nil {
+		var versionErr *protocol.VersionError
+		if errors.As(err, &versionErr) {
+			protocol.Reject(conn, err.Error())
+			return fail("version", err)
 		}
+		if errors.Is(err, protocol.ErrInvalidMagic) {
+			protocol.Reject(conn, err.Error())
+			return fail("protocol", err)
+		}
+		return fail("io", err)
+	}
+	if msg.Type != protocol.MessageTypeAuth {
+		err = fmt.Errorf("unexpected message type: %d, expected %d", msg.Type, protocol.MessageTypeAuth)
+		protocol.Reject(conn, err.Error())
+		return fail("protocol", err)
+	}
 
-		// wait for challenge answer
-		select {
-		case <-s.Closed:
-			return errors.New("server closed")
-		case <-time.After(time.Second):
-			return errors.New("client challenge timed out")
-		case initialMessage := <-conn.Ch:
-			if initialMessage == nil {
-				return errors.New("client connection closed")
-			}
+	auth, err := protocol.UnmarshalAuth(msg.Payload)
+	if err != nil {
+		protocol.Reject(conn, err.Error())
+		return fail("protocol", err)
+	}
+
+	var key *AuthorizedKey
+	if auth.Signature != nil {
+		key, err = s.verifySignature(auth, tlsConn.ConnectionState(), challenge)
+	} else {
+		key, err = s.verifyCertificate(tlsConn.ConnectionState())
+	}
+	if err != nil {
+		protocol.Reject(conn, err.Error())
+		return fail("unauthorized", err)
+	}
+
+	// make sure the key may claim the role and the group
+	err = key.Allows(auth.Role, auth.Group)
+	if err != nil {
+		protocol.Reject(conn, err.Error())
+		return fail("forbidden", err)
+	}
+
+	accept := &protocol.Accept{Framing: auth.Framed()}
+	err = protocol.WriteMessage(conn, protocol.MessageTypeAccept, accept.Marshal())
+	if err != nil {
+		return fail("io", err)
+	}
+
+	return auth, key, nil
+}
+
+func (s *RelayServer) verifySignature(auth *protocol.Auth, state tls.ConnectionState, challenge []byte) (*AuthorizedKey, error) {
+	if s.authMode == AuthModeMTLS {
+		return nil, errors.New("ed25519 authentication is disabled, a client certificate is required")
+	}
+
+	key := s.keyring.Lookup(auth.PublicKey)
+	if key == nil {
+		return nil, errors.New("unknown public key")
+	}
 
-			var signature []byte
-			if len(initialMessage) == 1+1+64 { // flag + group id + signature
-				// set the group id
-				conn.GroupId = initialMessage[1]
-				signature = initialMessage[1+1:]
-			} else if len(initialMessage) == 1+64 { // flag + signature
-				// use default group id
-				conn.GroupId = 0
-				signature = initialMessage[1:]
-			} else {
-				return errors.New("client sent invalid initial message")
+	// verify challenge signature
+	if !auth.Verify(key.PublicKey, state, challenge) {
+		return nil, fmt.Errorf("challenge verification failed for key %s", key.Name)
+	}
+
+	return key, nil
+}
+
+func (s *RelayServer) verifyCertificate(state tls.ConnectionState) (*AuthorizedKey, error) {
+	if s.authMode == AuthModeEd25519 {
+		return nil, errors.New("certificate authentication is disabled, a signature is required")
+	}
+
+	// the certificate has already been verified against the client ca by the tls handshake
+	if len(state.VerifiedChains) == 0 {
+		return nil, errors.New("missing client certificate")
+	}
+
+	return CertificateIdentity(state.VerifiedChains[0][0])
+}
+
+func (s *RelayServer) HandleConnection(conn net.Conn) {
+	auth, key, err := s.handshake(conn)
+	if err != nil {
+		conn.Close()
+		logger.Warn("handshake failed", slog.String(logging.KeyRemoteAddr, conn.RemoteAddr().String()), logging.Err(err))
+		return
+	}
+
+	// set the connection type
+	var connType string
+	if auth.Role == protocol.RoleUp {
+		connType = constant.ConnTypeUp
+	} else {
+		connType = constant.ConnTypeDown
+	}
+
+	onInit := func(conn *common.Conn) error {
+		// set the group
+		conn.Group = auth.Group
+		// set the identity
+		conn.Identity = key.Name
+		// connections of the same client process are balanced as one peer
+		conn.Peer = key.Name
+		if auth.Instance != "" {
+			conn.Peer += "/" + auth.Instance
+		}
+		conn.Weight = int(auth.Weight)
+
+		// a connection of the entry-point is only connected once its session starts,
+		// so that the balancer counts sessions instead of idle connections and knows the client
+		if connType == constant.ConnTypeDown {
+			msg, err := protocol.ExpectMessage(conn, protocol.MessageTypeRoute)
+			if err != nil {
+				return err
 			}
 
-			// set the connection type
-			if initialMessage[0] == 1 {
-				conn.Type = constant.ConnTypeUp
-			} else {
-				conn.Type = constant.ConnTypeDown
+			route, err := protocol.UnmarshalRoute(msg.Payload)
+			if err != nil {
+				return fmt.Errorf("invalid route: %w", err)
 			}
+			conn.Source = route.Source
+			conn.RouteName = route.String()
 
-			// verify challenge signature
-			if !ed25519.Verify(s.authPublicKeyBytes, randomBytes, signature) {
-				return errors.New("client challenge verification failed")
+			// the route is forwarded to the reverse-proxy before anything else
+			conn.Route, err = protocol.EncodeMessage(protocol.MessageTypeRoute, msg.Payload)
+			if err != nil {
+				return err
 			}
+		}
 
-			return nil
+		return nil
+	}
+
+	logger.Debug("client authenticated",
+		slog.String(logging.KeyGroup, auth.Group),
+		slog.String(logging.KeyRemoteAddr, conn.RemoteAddr().String()),
+		slog.String("identity", key.Name),
+		slog.String("type", connType),
+	)
+
+	s.addClient(conn, &client{key, auth.Role, auth.Group})
+	defer s.removeClient(conn)
+
+	if auth.Multiplex {
+		s.serveSession(mux.Server(conn), connType, onInit)
+		return
+	}
+
+	if auth.Framed() {
+		conn = protocol.NewFramedConn(conn)
+	}
+	s.CommonServer.HandleConnection(conn, connType, onInit)
+}
+
+// serveSession handles every stream opened by the client as a separate connection,
+// all streams share the authentication of the session
+func (s *RelayServer) serveSession(session *mux.Session, connType string, onInit func(conn *common.Conn) error) {
+	defer session.Close()
+
+	logger.Info("session opened", slog.String(logging.KeyRemoteAddr, session.RemoteAddr().String()))
+
+	go func() {
+		select {
+		case <-s.Closed:
+			session.Close()
+		case <-session.Closed():
 		}
-	})
+	}()
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			logger.Info("session closed", slog.String(logging.KeyRemoteAddr, session.RemoteAddr().String()), logging.Err(err))
+			return
+		}
+
+		go s.CommonServer.HandleConnection(stream, connType, onInit)
+	}
 }
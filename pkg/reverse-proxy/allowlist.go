@@ -0,0 +1,205 @@
+package reverse_proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type AllowRule struct {
+	// "tcp", "udp" or empty for both
+	Network string
+
+	// exactly one of them is set
+	Prefix netip.Prefix
+	// a hostname, or a wildcard like *.internal
+	Host string
+	// matches every destination
+	Any bool
+
+	MinPort uint16
+	MaxPort uint16
+}
+
+type Allowlist struct {
+	rules []AllowRule
+}
+
+// ParseAllowRule parses a rule in the following format:
+//
+//	[tcp/|udp/]target[:ports]
+//
+// target is an ip, a cidr, a hostname, a wildcard hostname like *.internal or *,
+// ipv6 targets must be wrapped in brackets when ports are given,
+// ports is a single port, a range like 8000-9000 or *, all ports are allowed if it is omitted
+func ParseAllowRule(rule string) (AllowRule, error) {
+	r := AllowRule{
+		MinPort: 0,
+		MaxPort: 65535,
+	}
+
+	if strings.HasPrefix(rule, "tcp/") {
+		r.Network = "tcp"
+		rule = strings.TrimPrefix(rule, "tcp/")
+	} else if strings.HasPrefix(rule, "udp/") {
+		r.Network = "udp"
+		rule = strings.TrimPrefix(rule, "udp/")
+	}
+
+	target := rule
+	ports := ""
+	hasPorts := false
+	if strings.HasPrefix(rule, "[") {
+		end := strings.Index(rule, "]")
+		if end < 0 {
+			return r, fmt.Errorf("invalid rule: %s", rule)
+		}
+		target = rule[1:end]
+		rest := rule[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return r, fmt.Errorf("invalid rule: %s", rule)
+			}
+			ports = rest[1:]
+			hasPorts = true
+		}
+	} else if strings.Count(rule, ":") == 1 {
+		target, ports, hasPorts = strings.Cut(rule, ":")
+	}
+
+	if hasPorts && ports != "*" {
+		min, max, isRange := strings.Cut(ports, "-")
+		minPort, err := strconv.ParseUint(min, 10, 16)
+		if err != nil {
+			return r, fmt.Errorf("invalid port: %s", min)
+		}
+		maxPort := minPort
+		if isRange {
+			maxPort, err = strconv.ParseUint(max, 10, 16)
+			if err != nil {
+				return r, fmt.Errorf("invalid port: %s", max)
+			}
+		}
+		if minPort > maxPort {
+			return r, fmt.Errorf("invalid port range: %s", ports)
+		}
+		r.MinPort = uint16(minPort)
+		r.MaxPort = uint16(maxPort)
+	}
+
+	if target == "*" {
+		r.Any = true
+	} else if prefix, err := netip.ParsePrefix(target); err == nil {
+		// destinations are unmapped before they are checked
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), max(prefix.Bits()-96, 0))
+		}
+		r.Prefix = prefix.Masked()
+	} else if addr, err := netip.ParseAddr(target); err == nil {
+		r.Prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+	} else if target != "" && !strings.ContainsAny(target, "/[]") {
+		r.Host = strings.ToLower(target)
+	} else {
+		return r, fmt.Errorf("invalid target: %s", target)
+	}
+
+	return r, nil
+}
+
+func NewAllowlist(rules []string) (*Allowlist, error) {
+	a := &Allowlist{}
+
+	for _, rule := range rules {
+		r, err := ParseAllowRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, r)
+	}
+
+	return a, nil
+}
+
+// LoadAllowlist reads one rule per line, empty lines and lines starting with # are ignored
+func LoadAllowlist(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+
+	return rules, scanner.Err()
+}
+
+func (a *Allowlist) Len() int {
+	return len(a.rules)
+}
+
+func (r *AllowRule) matchPort(network string, port uint16) bool {
+	return (r.Network == "" || r.Network == network) && port >= r.MinPort && port <= r.MaxPort
+}
+
+func (r *AllowRule) matchHost(host string) bool {
+	if r.Any {
+		return true
+	}
+	if strings.HasPrefix(r.Host, "*.") {
+		return strings.HasSuffix(host, r.Host[1:])
+	}
+	return r.Host == host
+}
+
+func (a *Allowlist) allowAddr(network string, addr netip.Addr, port uint16) bool {
+	for _, r := range a.rules {
+		if r.matchPort(network, port) && (r.Any || (r.Prefix.IsValid() && r.Prefix.Contains(addr))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check makes sure the destination is allowed and returns the host which should be dialed,
+// hostnames which are not allowed by name are resolved and dialed by the allowed ip
+// so that the result of the check can not be changed by a later lookup
+func (a *Allowlist) Check(network string, host string, port uint16) (string, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if a.allowAddr(network, addr.Unmap(), port) {
+			return host, nil
+		}
+		return "", fmt.Errorf("destination not allowed: %s/%s", network, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, r := range a.rules {
+		if (r.Host != "" || r.Any) && r.matchPort(network, port) && r.matchHost(name) {
+			return host, nil
+		}
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		if ok && a.allowAddr(network, addr.Unmap(), port) {
+			return addr.Unmap().String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("destination not allowed: %s/%s", network, net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
@@ -0,0 +1,114 @@
+package reverse_proxy
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParseAllowRule(t *testing.T) {
+	for _, test := range []struct {
+		rule     string
+		expected AllowRule
+	}{
+		{"*", AllowRule{Any: true, MinPort: 0, MaxPort: 65535}},
+		{"tcp/*:80", AllowRule{Network: "tcp", Any: true, MinPort: 80, MaxPort: 80}},
+		{"udp/10.0.0.1:53", AllowRule{Network: "udp", Prefix: netip.MustParsePrefix("10.0.0.1/32"), MinPort: 53, MaxPort: 53}},
+		{"10.1.2.3/8:8000-9000", AllowRule{Prefix: netip.MustParsePrefix("10.0.0.0/8"), MinPort: 8000, MaxPort: 9000}},
+		{"::1", AllowRule{Prefix: netip.MustParsePrefix("::1/128"), MinPort: 0, MaxPort: 65535}},
+		{"[fd00::/8]:*", AllowRule{Prefix: netip.MustParsePrefix("fd00::/8"), MinPort: 0, MaxPort: 65535}},
+		{"[::ffff:10.0.0.1]:443", AllowRule{Prefix: netip.MustParsePrefix("10.0.0.1/32"), MinPort: 443, MaxPort: 443}},
+		{"::ffff:10.0.0.0/104", AllowRule{Prefix: netip.MustParsePrefix("10.0.0.0/8"), MinPort: 0, MaxPort: 65535}},
+		{"DB.Internal:5432", AllowRule{Host: "db.internal", MinPort: 5432, MaxPort: 5432}},
+		{"*.internal", AllowRule{Host: "*.internal", MinPort: 0, MaxPort: 65535}},
+	} {
+		rule, err := ParseAllowRule(test.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", test.rule, err)
+		}
+		if rule != test.expected {
+			t.Fatalf("%s: expected %+v, got %+v", test.rule, test.expected, rule)
+		}
+	}
+}
+
+func TestParseAllowRuleMalformed(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"tcp/",
+		"10.0.0.1:",
+		"10.0.0.1:x",
+		"10.0.0.1:65536",
+		"10.0.0.1:90-80",
+		"10.0.0.1:80-",
+		"10.0.0.1/33",
+		"[::1",
+		"[::1]80",
+		"[::1]:",
+		"[::1]:x",
+		"[]:80",
+		"host/name",
+	} {
+		if r, err := ParseAllowRule(rule); err == nil {
+			t.Fatalf("%q: expected an error, got %+v", rule, r)
+		}
+	}
+}
+
+func TestAllowlistCheck(t *testing.T) {
+	allowlist, err := NewAllowlist([]string{
+		"tcp/10.0.0.0/8:80",
+		"udp/10.0.0.1:53",
+		"[fd00::/8]:443",
+		"*.internal:8000-9000",
+		"db.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		network string
+		host    string
+		port    uint16
+		allowed bool
+	}{
+		{"tcp", "10.1.2.3", 80, true},
+		{"tcp", "10.1.2.3", 81, false},
+		{"udp", "10.1.2.3", 80, false},
+		{"udp", "10.0.0.1", 53, true},
+		{"tcp", "10.0.0.1", 53, false},
+		{"tcp", "11.0.0.1", 80, false},
+		// ipv4-mapped ipv6 addresses are checked as ipv4
+		{"tcp", "::ffff:10.1.2.3", 80, true},
+		{"tcp", "::ffff:11.0.0.1", 80, false},
+		{"tcp", "fd00::1", 443, true},
+		{"udp", "fd00::1", 443, true},
+		{"tcp", "fe80::1", 443, false},
+		{"tcp", "a.internal", 8000, true},
+		{"tcp", "A.B.Internal.", 9000, true},
+		{"tcp", "a.internal", 9001, false},
+		{"tcp", "internal", 8000, false},
+		{"udp", "db.example.com", 1, true},
+	} {
+		host, err := allowlist.Check(test.network, test.host, test.port)
+		if test.allowed && (err != nil || host != test.host) {
+			t.Fatalf("%s/%s:%d: expected to be allowed, got %q %v", test.network, test.host, test.port, host, err)
+		}
+		if !test.allowed && err == nil {
+			t.Fatalf("%s/%s:%d: expected to be denied", test.network, test.host, test.port)
+		}
+	}
+}
+
+func TestEmptyAllowlistDeniesEverything(t *testing.T) {
+	allowlist, err := NewAllowlist(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"127.0.0.1", "::1", "::ffff:127.0.0.1"} {
+		if _, err := allowlist.Check("tcp", host, 80); err == nil {
+			t.Fatalf("%s: expected to be denied", host)
+		}
+	}
+}
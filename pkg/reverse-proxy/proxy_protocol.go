@@ -0,0 +1,90 @@
+package reverse_proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ProxyProtocolRule selects the destinations which receive a PROXY protocol header
+type ProxyProtocolRule struct {
+	AllowRule
+
+	// 1 for the text header, 2 for the binary one
+	Version int
+}
+
+// ParseProxyProtocolRule parses a rule in the following format:
+//
+//	[v1=|v2=][tcp/]target[:ports]
+//
+// the target and the ports are the same as the ones of the allowlist, v1 is used if the version is omitted,
+// the header is only sent over tcp
+func ParseProxyProtocolRule(rule string) (ProxyProtocolRule, error) {
+	r := ProxyProtocolRule{
+		Version: 1,
+	}
+
+	if version, target, ok := strings.Cut(rule, "="); ok {
+		switch version {
+		case "v1":
+			r.Version = 1
+		case "v2":
+			r.Version = 2
+		default:
+			return r, fmt.Errorf("invalid proxy protocol version: %s", version)
+		}
+		rule = target
+	}
+
+	var err error
+	r.AllowRule, err = ParseAllowRule(rule)
+	if err != nil {
+		return r, err
+	}
+	if r.Network == "udp" {
+		return r, fmt.Errorf("the proxy protocol is only supported over tcp: %s", rule)
+	}
+
+	return r, nil
+}
+
+type ProxyProtocol struct {
+	rules []ProxyProtocolRule
+}
+
+func NewProxyProtocol(rules []string) (*ProxyProtocol, error) {
+	p := &ProxyProtocol{}
+
+	for _, rule := range rules {
+		r, err := ParseProxyProtocolRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		p.rules = append(p.rules, r)
+	}
+
+	return p, nil
+}
+
+func (p *ProxyProtocol) Len() int {
+	return len(p.rules)
+}
+
+// Version returns the version of the header sent to a tcp destination, zero means no header,
+// host is the destination of the route, and addr the ip which has been dialed,
+// the first matching rule wins
+func (p *ProxyProtocol) Version(host string, addr netip.Addr, port uint16) int {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	addr = addr.Unmap()
+
+	for _, r := range p.rules {
+		if !r.matchPort("tcp", port) {
+			continue
+		}
+		if r.Any || (r.Prefix.IsValid() && r.Prefix.Contains(addr)) || (r.Host != "" && r.matchHost(name)) {
+			return r.Version
+		}
+	}
+	return 0
+}
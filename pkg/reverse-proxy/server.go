@@ -1,24 +1,39 @@
 package reverse_proxy
 
 import (
-	"crypto/x509"
-	"encoding/binary"
-	"errors"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"net"
+	"net/netip"
 	"strconv"
 
 	"github.com/samlior/tcp-reverse-proxy/pkg/common"
 	"github.com/samlior/tcp-reverse-proxy/pkg/constant"
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+	"github.com/samlior/tcp-reverse-proxy/pkg/protocol"
+	"github.com/samlior/tcp-reverse-proxy/pkg/proxyproto"
+	"github.com/samlior/tcp-reverse-proxy/pkg/udp"
 )
 
+var logger = logging.New("reverse-proxy")
+
 type ReverseProxyServer struct {
 	*common.KeepDialingServer
+
+	// the destinations which receive a PROXY protocol header, none if it is nil
+	ProxyProtocol *ProxyProtocol
 }
 
-func NewReverseProxyServer(groupId uint8, serverAddress string, authPrivateKeyBytes []byte, certPool *x509.CertPool) *ReverseProxyServer {
-	ks := common.NewKeepDialingServer(groupId, true, serverAddress, authPrivateKeyBytes, certPool)
+// NewReverseProxyServer creates a reverse proxy server,
+// every destination is allowed if allowlist is nil
+func NewReverseProxyServer(group string, serverAddresses []string, authPrivateKeyBytes []byte, tlsConfig *tls.Config, multiplex int, minPoolSize int, maxPoolSize int, allowlist *Allowlist) *ReverseProxyServer {
+	ks := common.NewKeepDialingServer(group, true, serverAddresses, authPrivateKeyBytes, tlsConfig, multiplex, minPoolSize, maxPoolSize)
+	// the connections to the relay server carry the data of the clients
+	ks.ClientConnType = constant.ConnTypeUp
+
+	s := &ReverseProxyServer{
+		KeepDialingServer: ks,
+	}
 
 	ks.OnDial = func(conn *common.Conn) error {
 		if conn.Type != constant.ConnTypeUp {
@@ -26,48 +41,106 @@ func NewReverseProxyServer(groupId uint8, serverAddress string, authPrivateKeyBy
 			return nil
 		}
 
-		select {
-		case <-ks.Closed:
-			return errors.New("server closed")
-		case route := <-conn.Ch:
-			if route == nil {
-				return io.EOF
-			}
-			if len(route) != 16+2 {
-				return fmt.Errorf("invalid route: %v, len: %d", route, len(route))
-			}
+		// wait for the route sent by the entry-point,
+		// the data following it stays buffered in the connection
+		msg, err := protocol.ExpectMessage(conn, protocol.MessageTypeRoute)
+		if err != nil {
+			return err
+		}
 
-			// set the match id
-			conn.MatchId = route
-
-			var dstHost string
-			if route[0] != 0 {
-				// ipv6
-				dstHost = net.IP(route).String()
-			} else {
-				// ipv4
-				dstHost = net.IP(route[12:16]).String()
-			}
+		route, err := protocol.UnmarshalRoute(msg.Payload)
+		if err != nil {
+			return fmt.Errorf("invalid route: %w", err)
+		}
 
-			dstPort := binary.BigEndian.Uint16(route[16:])
+		// set the match id
+		conn.MatchId = msg.Payload
+		conn.RouteName = route.String()
 
-			downConn, err := net.Dial("tcp", dstHost+":"+strconv.Itoa(int(dstPort)))
+		network := "tcp"
+		if route.Network == protocol.NetworkUDP {
+			network = "udp"
+		}
+
+		// domain names are resolved in our own network
+		dstAddress := route.Destination.String()
+		if allowlist != nil {
+			host, err := allowlist.Check(network, route.Destination.Host, route.Destination.Port)
 			if err != nil {
+				logger.Warn("route rejected", conn.LogAttrs(logging.Err(err))...)
 				return err
 			}
+			dstAddress = net.JoinHostPort(host, strconv.Itoa(int(route.Destination.Port)))
+		}
 
-			go ks.HandleConnection(downConn, constant.ConnTypeDown, func(conn *common.Conn) error {
-				// set the match id
-				conn.MatchId = route
+		var downConn net.Conn
+		if network == "udp" {
+			udpConn, err := net.Dial("udp", dstAddress)
+			if err != nil {
+				return err
+			}
+			downConn = udp.NewConn(udpConn, constant.UDPIdleTimeout)
+		} else {
+			downConn, err = net.Dial("tcp", dstAddress)
+			if err != nil {
+				return err
+			}
 
-				return nil
-			})
+			err = s.writeProxyHeader(downConn, route)
+			if err != nil {
+				downConn.Close()
+				return err
+			}
+		}
+
+		go ks.HandleConnection(downConn, constant.ConnTypeDown, func(conn *common.Conn) error {
+			// set the match id
+			conn.MatchId = msg.Payload
 
 			return nil
-		}
+		})
+
+		return nil
 	}
 
-	return &ReverseProxyServer{
-		KeepDialingServer: ks,
+	return s
+}
+
+// addrPort converts the address of a route, it is invalid if the address is not an ip
+func addrPort(address protocol.Address) netip.AddrPort {
+	addr, err := netip.ParseAddr(address.Host)
+	if err != nil {
+		return netip.AddrPort{}
 	}
+	return netip.AddrPortFrom(addr, address.Port)
+}
+
+// writeProxyHeader sends the address of the client to the destination if a PROXY protocol rule selects it,
+// the client is unknown if the entry-point does not send its address
+func (s *ReverseProxyServer) writeProxyHeader(conn net.Conn, route *protocol.Route) error {
+	if s.ProxyProtocol == nil {
+		return nil
+	}
+
+	remote, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+
+	version := s.ProxyProtocol.Version(route.Destination.Host, remote.Addr(), route.Destination.Port)
+	if version == 0 {
+		return nil
+	}
+
+	header, err := (&proxyproto.Header{
+		Network:     "tcp",
+		Source:      addrPort(route.Source),
+		Destination: addrPort(route.Listener),
+	}).Marshal(version)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(header)
+	return err
 }
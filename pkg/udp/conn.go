@@ -0,0 +1,114 @@
+package udp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn wraps a connected udp socket so that it reads and writes framed datagrams,
+// it expires once no datagram has been exchanged for the idle timeout
+type Conn struct {
+	net.Conn
+
+	idleTimeout time.Duration
+	// unix nano of the last datagram in either direction
+	lastActivity atomic.Int64
+
+	readLock     sync.Mutex
+	readBuffer   []byte
+	framer       framer
+	readDeadline atomic.Value
+
+	writeLock sync.Mutex
+	deframer  deframer
+}
+
+func NewConn(conn net.Conn, idleTimeout time.Duration) *Conn {
+	c := &Conn{
+		Conn:        conn,
+		idleTimeout: idleTimeout,
+		readBuffer:  make([]byte, maxDatagramSize),
+	}
+	c.lastActivity.Store(time.Now().UnixNano())
+	c.readDeadline.Store(time.Time{})
+	return c
+}
+
+func (c *Conn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *Conn) readDatagram() ([]byte, error) {
+	for {
+		// wake up periodically to check whether the flow is still active,
+		// the user deadline takes precedence if it is earlier
+		expiry := time.Unix(0, c.lastActivity.Load()).Add(c.idleTimeout)
+		deadline := c.readDeadline.Load().(time.Time)
+		if deadline.IsZero() || expiry.Before(deadline) {
+			c.Conn.SetReadDeadline(expiry)
+		} else {
+			c.Conn.SetReadDeadline(deadline)
+		}
+
+		length, err := c.Conn.Read(c.readBuffer)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			deadline := c.readDeadline.Load().(time.Time)
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				return nil, err
+			}
+			// an idle flow ends like a closed one, the session is not aborted
+			if time.Since(time.Unix(0, c.lastActivity.Load())) >= c.idleTimeout {
+				return nil, io.EOF
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		c.touch()
+
+		datagram := make([]byte, length)
+		copy(datagram, c.readBuffer[:length])
+		return datagram, nil
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	return c.framer.read(p, c.readDatagram)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	err := c.deframer.write(b, func(datagram []byte) error {
+		c.touch()
+		_, err := c.Conn.Write(datagram)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+
+	// interrupt a blocked read so that it picks up the new deadline
+	return c.Conn.SetReadDeadline(time.Now())
+}
@@ -0,0 +1,133 @@
+package udp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flow is the datagrams exchanged with a single client of a listener
+type Flow struct {
+	listener   *Listener
+	remoteAddr net.Addr
+
+	ch        chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// unix nano of the last datagram in either direction
+	lastActivity atomic.Int64
+
+	readLock        sync.Mutex
+	framer          framer
+	readDeadline    atomic.Value
+	deadlineChanged chan struct{}
+
+	writeLock sync.Mutex
+	deframer  deframer
+}
+
+func newFlow(listener *Listener, remoteAddr net.Addr) *Flow {
+	f := &Flow{
+		listener:   listener,
+		remoteAddr: remoteAddr,
+		ch:         make(chan []byte, flowBacklog),
+		closed:     make(chan struct{}),
+
+		deadlineChanged: make(chan struct{}, 1),
+	}
+	f.touch()
+	f.readDeadline.Store(time.Time{})
+	return f
+}
+
+func (f *Flow) touch() {
+	f.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (f *Flow) idle() time.Duration {
+	return time.Since(time.Unix(0, f.lastActivity.Load()))
+}
+
+func (f *Flow) push(datagram []byte) {
+	f.touch()
+
+	select {
+	case f.ch <- datagram:
+	default:
+		// drop the datagram like a full socket buffer would
+	}
+}
+
+func (f *Flow) Read(p []byte) (int, error) {
+	f.readLock.Lock()
+	defer f.readLock.Unlock()
+
+	return f.framer.read(p, func() ([]byte, error) {
+		for {
+			datagram, err := waitDatagram(f.ch, f.closed, f.readDeadline.Load().(time.Time), f.deadlineChanged)
+			if err != errDeadlineChanged {
+				return datagram, err
+			}
+		}
+	})
+}
+
+func (f *Flow) Write(b []byte) (int, error) {
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+
+	select {
+	case <-f.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	err := f.deframer.write(b, func(datagram []byte) error {
+		f.touch()
+		_, err := f.listener.conn.WriteTo(datagram, f.remoteAddr)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (f *Flow) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		f.listener.removeFlow(f)
+	})
+	return nil
+}
+
+func (f *Flow) LocalAddr() net.Addr {
+	return f.listener.conn.LocalAddr()
+}
+
+func (f *Flow) RemoteAddr() net.Addr {
+	return f.remoteAddr
+}
+
+func (f *Flow) SetDeadline(t time.Time) error {
+	return f.SetReadDeadline(t)
+}
+
+func (f *Flow) SetReadDeadline(t time.Time) error {
+	f.readDeadline.Store(t)
+
+	// wake up the reader so that it picks up the new deadline
+	select {
+	case f.deadlineChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (f *Flow) SetWriteDeadline(t time.Time) error {
+	return nil
+}
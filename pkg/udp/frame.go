@@ -0,0 +1,95 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// datagrams are carried through the tunnel as:
+//
+//	length(2) | payload(length)
+const (
+	frameHeaderSize = 2
+	maxDatagramSize = 0xffff
+)
+
+// framer turns datagrams into a byte stream which can be read in arbitrary pieces
+type framer struct {
+	pending []byte
+}
+
+func (f *framer) read(p []byte, next func() ([]byte, error)) (int, error) {
+	if len(f.pending) == 0 {
+		datagram, err := next()
+		if err != nil {
+			return 0, err
+		}
+
+		f.pending = binary.BigEndian.AppendUint16(make([]byte, 0, frameHeaderSize+len(datagram)), uint16(len(datagram)))
+		f.pending = append(f.pending, datagram...)
+	}
+
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// deframer turns a byte stream back into datagrams
+type deframer struct {
+	buffer []byte
+}
+
+func (d *deframer) write(b []byte, send func([]byte) error) error {
+	d.buffer = append(d.buffer, b...)
+
+	for len(d.buffer) >= frameHeaderSize {
+		length := int(binary.BigEndian.Uint16(d.buffer))
+		if len(d.buffer) < frameHeaderSize+length {
+			break
+		}
+
+		err := send(d.buffer[frameHeaderSize : frameHeaderSize+length])
+		if err != nil {
+			return err
+		}
+		d.buffer = d.buffer[frameHeaderSize+length:]
+	}
+
+	// release the memory once everything has been sent
+	if len(d.buffer) == 0 {
+		d.buffer = nil
+	}
+
+	return nil
+}
+
+// returned by waitDatagram when the deadline has been changed while waiting
+var errDeadlineChanged = errors.New("deadline changed")
+
+// waitDatagram waits for the next datagram until the deadline
+func waitDatagram(ch <-chan []byte, closed <-chan struct{}, deadline time.Time, deadlineChanged <-chan struct{}) ([]byte, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case datagram := <-ch:
+		return datagram, nil
+	case <-closed:
+		return nil, io.EOF
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	case <-deadlineChanged:
+		return nil, errDeadlineChanged
+	}
+}
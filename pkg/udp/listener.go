@@ -0,0 +1,136 @@
+package udp
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/samlior/tcp-reverse-proxy/pkg/logging"
+)
+
+var logger = logging.New("udp")
+
+// number of datagrams queued per flow,
+// datagrams are dropped when the queue is full
+const flowBacklog = 64
+
+// Listener tracks the flows of every client sending datagrams to a packet conn,
+// each flow is exposed as a net.Conn carrying framed datagrams
+type Listener struct {
+	conn        net.PacketConn
+	idleTimeout time.Duration
+	onFlow      func(net.Conn)
+
+	lock  sync.Mutex
+	flows map[string]*Flow
+
+	// closed when the listener is closed, it stops the expiration of the flows
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewListener(conn net.PacketConn, idleTimeout time.Duration, onFlow func(net.Conn)) *Listener {
+	return &Listener{
+		conn:        conn,
+		idleTimeout: idleTimeout,
+		onFlow:      onFlow,
+		flows:       make(map[string]*Flow),
+		done:        make(chan struct{}),
+	}
+}
+
+func (l *Listener) Serve() {
+	go l.expire()
+	// the packet conn may have been closed by someone else
+	defer l.Close()
+
+	buffer := make([]byte, maxDatagramSize)
+
+	for {
+		length, addr, err := l.conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Warn("failed to read datagram", logging.Err(err))
+			continue
+		}
+
+		datagram := make([]byte, length)
+		copy(datagram, buffer[:length])
+
+		l.lock.Lock()
+		flow, ok := l.flows[addr.String()]
+		if !ok {
+			flow = newFlow(l, addr)
+			l.flows[addr.String()] = flow
+		}
+		l.lock.Unlock()
+
+		if !ok {
+			go l.onFlow(flow)
+		}
+
+		flow.push(datagram)
+	}
+}
+
+// expire closes the flows which have been idle for too long
+func (l *Listener) expire() {
+	ticker := time.NewTicker(l.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+
+		var expired []*Flow
+
+		l.lock.Lock()
+		for _, flow := range l.flows {
+			if flow.idle() > l.idleTimeout {
+				expired = append(expired, flow)
+			}
+		}
+		l.lock.Unlock()
+
+		for _, flow := range expired {
+			logger.Debug("udp flow expired", slog.String(logging.KeyRemoteAddr, flow.remoteAddr.String()))
+			flow.Close()
+		}
+	}
+}
+
+// Close closes the packet conn and every flow
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	err := l.conn.Close()
+
+	l.lock.Lock()
+	flows := make([]*Flow, 0, len(l.flows))
+	for _, flow := range l.flows {
+		flows = append(flows, flow)
+	}
+	l.lock.Unlock()
+
+	for _, flow := range flows {
+		flow.Close()
+	}
+	return err
+}
+
+func (l *Listener) removeFlow(flow *Flow) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.flows[flow.remoteAddr.String()] == flow {
+		delete(l.flows, flow.remoteAddr.String())
+	}
+}